@@ -0,0 +1,161 @@
+/**
+ * Archives of results.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Name of the manifest appended to every archive.
+const ManifestName = "MANIFEST.json"
+
+// ManifestEntry describes a result stored in an archive.
+type ManifestEntry struct {
+	Job         string `json:"job"`
+	Result      string `json:"result"`
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	ContentType string `json:"content_type"`
+}
+
+// archiveWriter abstracts the tar and the zip formats.
+type archiveWriter interface {
+	create(name string, size int64, mod time.Time) (io.Writer, error)
+	Close() error
+}
+
+type tarArchive struct {
+	*tar.Writer
+}
+
+func (t tarArchive) create(name string, size int64, mod time.Time) (io.Writer, error) {
+	hdr := &tar.Header{Name: name, Mode: 0600, Size: size, ModTime: mod, Typeflag: tar.TypeReg}
+	if err := t.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	return t.Writer, nil
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (z zipArchive) create(name string, size int64, mod time.Time) (io.Writer, error) {
+	hdr := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: mod}
+	return z.CreateHeader(hdr)
+}
+
+// gzipTarArchive is a tar archive compressed with gzip.
+type gzipTarArchive struct {
+	tarArchive
+	gz *gzip.Writer
+}
+
+func (g gzipTarArchive) Close() error {
+	if err := g.tarArchive.Close(); err != nil {
+		return err
+	}
+	return g.gz.Close()
+}
+
+// WriteResults streams the results of the given jobs in an archive
+// followed by a manifest. Supported formats are 'tar', 'tar.gz' and 'zip'.
+// When flat is true, the results are stored at the root of the archive,
+// otherwise they are stored in a directory named after their job. The
+// manifest tells where each result is stored.
+func WriteResults(w io.Writer, format string, jobs []*Job, flat bool) error {
+	var a archiveWriter
+	switch format {
+	case "tar":
+		a = tarArchive{tar.NewWriter(w)}
+	case "tar.gz":
+		gz := gzip.NewWriter(w)
+		a = gzipTarArchive{tarArchive{tar.NewWriter(gz)}, gz}
+	case "zip":
+		a = zipArchive{zip.NewWriter(w)}
+	default:
+		return fmt.Errorf("Unsupported archive format '%s'", format)
+	}
+	manifest := make([]ManifestEntry, 0)
+	for _, j := range jobs {
+		results := j.Results()
+		for _, r := range results {
+			path := j.Id() + "/" + r
+			if flat {
+				path = flatPath(r, results)
+			}
+			e, err := writeResult(a, j, r, path)
+			if err != nil {
+				return err
+			}
+			manifest = append(manifest, e)
+		}
+	}
+	cnt, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	out, err := a.create(ManifestName, int64(len(cnt)), time.Now())
+	if err != nil {
+		return err
+	}
+	if _, err = out.Write(cnt); err != nil {
+		return err
+	}
+	return a.Close()
+}
+
+// flatPath returns where a result is stored at the root of an archive. A
+// result named like the manifest is prefixed with underscores until it
+// collides with no other result.
+func flatPath(r string, results []string) string {
+	if r != ManifestName {
+		return r
+	}
+	used := make(map[string]bool, len(results))
+	for _, x := range results {
+		used[x] = true
+	}
+	r = "_" + r
+	for used[r] {
+		r = "_" + r
+	}
+	return r
+}
+
+func writeResult(a archiveWriter, j *Job, r, path string) (ManifestEntry, error) {
+	e := ManifestEntry{Job: j.Id(), Result: r, Path: path}
+	f, err := j.OpenResult(r)
+	if err != nil {
+		return e, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return e, err
+	}
+	out, err := a.create(path, stat.Size(), stat.ModTime())
+	if err != nil {
+		return e, err
+	}
+	h := sha256.New()
+	if e.Size, err = io.Copy(io.MultiWriter(out, h), f); err != nil {
+		return e, err
+	}
+	info, _ := j.ResultInfo(r)
+	e.ContentType = info.ContentType
+	e.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return e, nil
+}
@@ -0,0 +1,62 @@
+/**
+ * Archives of results.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// In a flat archive, the results named like the manifest must neither
+// replace it nor be replaced.
+func TestFlatArchiveKeepsManifest(t *testing.T) {
+	idx, err := NewIndex(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := lead(t, idx, fixture{"j", JobSpec{}, terminated, map[string]string{
+		ManifestName:       "mine",
+		"_" + ManifestName: "mine too",
+		"out.txt":          "42",
+	}})
+	var buf bytes.Buffer
+	if err = WriteResults(&buf, "tar", []*Job{j}, true); err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := files[hdr.Name]; ok {
+			t.Errorf("'%s' stored twice", hdr.Name)
+		}
+		if files[hdr.Name], err = ioutil.ReadAll(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var manifest []ManifestEntry
+	if err = json.Unmarshal(files[ManifestName], &manifest); err != nil {
+		t.Fatalf("manifest: %s", err)
+	}
+	if len(manifest) != 3 {
+		t.Fatalf("%d result(s) in the manifest, expected 3", len(manifest))
+	}
+	for _, e := range manifest {
+		_, expected, _ := j.Result(e.Result)
+		if !bytes.Equal(files[e.Path], expected) {
+			t.Errorf("'%s' stored in '%s' is '%s', expected '%s'", e.Result, e.Path, files[e.Path], expected)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+/**
+ * Append-only log of the job state changes.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Name of the audit log in the root directory.
+const auditFile = "audit.log"
+
+// Identity of bipd itself when it changes a job state.
+const SystemActor = "bipd"
+
+// AuditEntry is a state change. From is empty for a job creation.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Who       string    `json:"who"`
+	RequestId string    `json:"request_id,omitempty"`
+	Job       string    `json:"job"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+}
+
+// Actor identifies who changes a job state.
+type Actor struct {
+	Who       string
+	RequestId string
+}
+
+// System is the actor for the changes decided by bipd.
+var System = Actor{Who: SystemActor}
+
+// AuditLog records every state change as a JSON line.
+type AuditLog struct {
+	lock sync.Mutex
+	path string
+	f    *os.File
+}
+
+// OpenAuditLog opens an audit log for appending.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{path: path, f: f}, nil
+}
+
+// record appends a state change. Failures are logged as the change is
+// already effective.
+func (a *AuditLog) record(by Actor, job string, from, to string) {
+	if a == nil {
+		return
+	}
+	e := AuditEntry{time.Now().UTC(), by.Who, by.RequestId, job, from, to}
+	cnt, err := json.Marshal(e)
+	if err == nil {
+		a.lock.Lock()
+		_, err = a.f.Write(append(cnt, '\n'))
+		a.lock.Unlock()
+	}
+	if err != nil {
+		slog.Error("unable to write the audit log", "job", job, "from", from, "to", to, "error", err)
+	}
+}
+
+// History returns the state changes of a job, oldest first.
+func (a *AuditLog) History(job string) ([]AuditEntry, error) {
+	res := make([]AuditEntry, 0)
+	err := a.scan(func(e AuditEntry) {
+		if e.Job == job {
+			res = append(res, e)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// scan calls fn on every state change, oldest first.
+func (a *AuditLog) scan(fn func(AuditEntry)) error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			//A line partially written on a crash
+			continue
+		}
+		fn(e)
+	}
+	return s.Err()
+}
+
+// Sync flushes the audit log to the disk.
+func (a *AuditLog) Sync() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.f.Sync()
+}
+
+// size returns the number of bytes written so far.
+func (a *AuditLog) size() (int64, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	stat, err := a.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
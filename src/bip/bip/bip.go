@@ -6,42 +6,54 @@
 package main
 
 import (
-	"fmt"
-	"os"
-	"net/http"
-	"io/ioutil"
+	"bip"
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
+
 var remote string
 var commands map[string]Command
 
 type Command struct {
-	Id string
+	Id        string
 	ShortHelp string
-	LongHelp string
-	Fn func([]string)
+	LongHelp  string
+	Fn        func([]string)
 }
 
 func ListJobs(args []string) {
 	flagSet := flag.NewFlagSet("", 0)
 	toJSON := flagSet.Bool("to-json", false, "")
-	withStatus :=  flagSet.Bool("with-status", false, "")
+	withStatus := flagSet.Bool("with-status", false, "")
 	flagSet.Parse(args)
 
 	res, err := http.Get(remote + "/jobs/")
-	if (err != nil) {
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to list the jobs: %s\n", err)
-		os.Exit(1)
+		os.Exit(exitNetwork)
 	}
-	if (res.StatusCode == http.StatusOK) {
+	if res.StatusCode == http.StatusOK {
 		cnt, _ := ioutil.ReadAll(res.Body)
-		if (!*toJSON) {
-			var js interface {}
+		if !*toJSON {
+			var js interface{}
 			json.Unmarshal(cnt, &js)
 			m := js.([]interface{})
 			for _, v := range m {
-				job := v.(map[string]interface {})
+				job := v.(map[string]interface{})
 				if !*withStatus {
 					fmt.Printf("%s\n", job["id"])
 				} else {
@@ -52,216 +64,822 @@ func ListJobs(args []string) {
 			fmt.Printf("%s", cnt)
 		}
 	} else {
-		errorMsgAndQuit(res, 2)
+		errorMsgAndQuit(res, exitServer)
 	}
 }
 
-func Put(args [] string) {
-	checkArity(args, 1, commands["put"])
-	id := args[0]
-	res, err := http.Post(remote + "/jobs/?j=" + id, "", os.Stdin)
-	if (err != nil) {
+func Put(args []string) {
+	flagSet := flag.NewFlagSet("", 0)
+	labels := flagSet.String("l", "", "")
+	at := flagSet.String("at", "", "")
+	in := flagSet.String("in", "", "")
+	deadline := flagSet.String("deadline", "", "")
+	timeout := flagSet.String("timeout", "", "")
+	retries := flagSet.String("retries", "", "")
+	resources := flagSet.String("resources", "", "")
+	constraints := flagSet.String("constraints", "", "")
+	flagSet.Parse(args)
+	checkArity(flagSet.Args(), 1, commands["put"])
+	id := flagSet.Args()[0]
+	u := remote + "/jobs/?j=" + url.QueryEscape(id)
+	if *labels != "" {
+		u += "&l=" + url.QueryEscape(*labels)
+	}
+	if *at != "" && *in != "" {
+		fmt.Fprintf(os.Stderr, "--at and --in are exclusive. 'bip help put' to help\n")
+		os.Exit(exitUsage)
+	} else if *at != "" {
+		u += "&not_before=" + url.QueryEscape(*at)
+	} else if *in != "" {
+		u += "&not_before=" + url.QueryEscape(*in)
+	}
+	for k, v := range map[string]string{"deadline": *deadline, "timeout": *timeout, "retries": *retries,
+		"resources": *resources, "constraints": *constraints} {
+		if v != "" {
+			u += "&" + k + "=" + url.QueryEscape(v)
+		}
+	}
+	//Buffered, so the submission can be retried
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read the job data: %s\n", err)
+		os.Exit(exitUsage)
+	}
+	res, err := http.Post(u, "", bytes.NewReader(data))
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to submit the job: %s\n", err)
-		os.Exit(-1)
+		os.Exit(exitNetwork)
 	}
-	if (res.StatusCode == http.StatusConflict) {
-		fmt.Fprintf(os.Stderr, "Job '%s' already exists\n", id)
-		os.Exit(2)
-	} else if (res.StatusCode != http.StatusCreated) {
-		errorMsgAndQuit(res, 2)
+	if res.StatusCode != http.StatusCreated {
+		errorMsgAndQuit(res, exitServer)
 	}
 }
 
 func Process(args []string) {
-	if (len(args) == 0) {
+	flagSet := flag.NewFlagSet("", 0)
+	worker := flagSet.String("w", os.Getenv("BIP_WORKER"), "")
+	resources := flagSet.String("resources", os.Getenv("BIP_RESOURCES"), "")
+	attributes := flagSet.String("attributes", os.Getenv("BIP_ATTRIBUTES"), "")
+	flagSet.Parse(args)
+	args = flagSet.Args()
+	v := url.Values{}
+	for k, x := range map[string]string{"worker": *worker, "resources": *resources, "attributes": *attributes} {
+		if x != "" {
+			v.Set(k, x)
+		}
+	}
+	q := v.Encode()
+	if len(args) == 0 {
 		fmt.Println("Process a random job")
 		//Get a random processable job
-		req, err := http.NewRequest("PUT", remote + "/jobs/", nil)
-		if (err != nil) {
+		req, err := http.NewRequest("PUT", remote+"/jobs/?"+q, nil)
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s\n", err)
-			os.Exit(-1)
+			os.Exit(exitNetwork)
 		}
 		res, err := http.DefaultClient.Do(req)
-		if (err != nil) {
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "Unable to submit the request: %s\n", err)
-			os.Exit(-1)
-		} else if (res.StatusCode == http.StatusOK) {
+			os.Exit(exitNetwork)
+		} else if res.StatusCode == http.StatusOK {
 			cnt, _ := ioutil.ReadAll(res.Body)
 			fmt.Printf("%s", cnt)
-		} else if (res.StatusCode == http.StatusNoContent) {
-			os.Exit(3)
+		} else if res.StatusCode == http.StatusNoContent {
+			os.Exit(exitNoJob)
 		} else {
-			errorMsgAndQuit(res, 2)
+			errorMsgAndQuit(res, exitServer)
 		}
-	} else if (len(args) == 1) {
+	} else if len(args) == 1 {
 		//process a given job
 		fmt.Printf("Process job %s\n", args[0])
-		req, err := http.NewRequest("PUT", remote + "/jobs/" + args[0] + "/status?s=processing", nil)
-		if (err != nil) {
+		req, err := http.NewRequest("PUT", remote+"/jobs/"+args[0]+"/status?s=processing&"+q, nil)
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s\n", err)
-			os.Exit(-1)
+			os.Exit(exitNetwork)
 		}
 		res, err := http.DefaultClient.Do(req)
-		if (err != nil) {
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "Unable to submit the request: %s\n", err)
-			os.Exit(-1)
+			os.Exit(exitNetwork)
 		}
-		if (res.StatusCode != http.StatusOK) {
-			errorMsgAndQuit(res, 2)
+		if res.StatusCode != http.StatusOK {
+			errorMsgAndQuit(res, exitServer)
 		}
 	}
 
 }
 
+// Exit codes. Each error code reported by the server has its own exit code.
+const (
+	exitUsage       = 1
+	exitServer      = 2
+	exitNoJob       = 3
+	exitNotFound    = 4
+	exitExists      = 5
+	exitBadStatus   = 6
+	exitBadRequest  = 7
+	exitStorage     = 8
+	exitUnavailable = 9
+	exitForbidden   = 10
+	exitBusy        = 11
+	exitQuota       = 12
+	exitNetwork     = 255
+)
+
+var exitCodes = map[string]int{
+	bip.CodeJobNotFound:      exitNotFound,
+	bip.CodeResultNotFound:   exitNotFound,
+	bip.CodeNoMatchingJob:    exitNotFound,
+	bip.CodeJobArchived:      exitNotFound,
+	bip.CodeCronNotFound:     exitNotFound,
+	bip.CodeCronExists:       exitExists,
+	bip.CodeWorkerNotFound:   exitNotFound,
+	bip.CodeWorkerBusy:       exitBusy,
+	bip.CodeQuotaExceeded:    exitQuota,
+	bip.CodeRateLimited:      exitQuota,
+	bip.CodeRequestTimeout:   exitBadRequest,
+	bip.CodeJobExists:        exitExists,
+	bip.CodeResultExists:     exitExists,
+	bip.CodeBadStatus:        exitBadStatus,
+	bip.CodeAttemptOver:      exitBadStatus,
+	bip.CodeMissingParameter: exitBadRequest,
+	bip.CodeInvalidParameter: exitBadRequest,
+	bip.CodeTooLarge:         exitBadRequest,
+	bip.CodeStorage:          exitStorage,
+	bip.CodeInternal:         exitServer,
+	bip.CodeUnavailable:      exitUnavailable,
+	bip.CodeAdminOnly:        exitForbidden,
+}
+
+const exitCodesHelp = `Exit codes:
+ 0: success
+ 1: invalid usage
+ 2: unexpected server error
+ 3: no job is waiting for being processed
+ 4: job, result, recurring job or worker not found, or job archived
+ 5: job, result or recurring job already exists
+ 6: the job status does not allow the operation
+ 7: missing or invalid parameter, or a too large or too slow request
+ 8: storage error on the server
+ 9: the server is not ready yet
+ 10: the operation is reserved to the administration endpoints
+ 11: the worker is processing as many jobs as allowed
+ 12: a quota or a rate limit is exceeded
+ 255: unable to reach the server
+`
+
+// errorMsgAndQuit prints the error reported by the server and exits
+// with the code matching the error. exitCode is used for the errors
+// without any known code.
 func errorMsgAndQuit(res *http.Response, exitCode int) {
 	cnt, _ := ioutil.ReadAll(res.Body)
-	fmt.Fprintf(os.Stderr, "Error '%s': %s", res.Status, cnt)
+	var e bip.APIError
+	if err := json.Unmarshal(cnt, &e); err != nil || e.Code == "" {
+		fmt.Fprintf(os.Stderr, "Error '%s': %s", res.Status, cnt)
+		os.Exit(exitCode)
+	}
+	fmt.Fprintf(os.Stderr, "Error '%s': %s\n", e.Code, e.Message)
+	if c, ok := exitCodes[e.Code]; ok {
+		exitCode = c
+	}
 	os.Exit(exitCode)
 }
 
 func Commit(args []string) {
 	checkArity(args, 1, commands["commit"])
 	id := args[0]
-	req, err := http.NewRequest("PUT", remote + "/jobs/" + id + "/status?s=terminated", nil)
-	if (err != nil) {
+	req, err := http.NewRequest("PUT", remote+"/jobs/"+id+"/status?s=terminated", nil)
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
-		os.Exit(-1)
+		os.Exit(exitNetwork)
 	}
 	res, err := http.DefaultClient.Do(req)
-	if (err != nil) {
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to submit the request: %s\n", err)
-		os.Exit(-1)
+		os.Exit(exitNetwork)
 	}
-	if (res.StatusCode != http.StatusOK) {
-		errorMsgAndQuit(res, 2)
+	if res.StatusCode != http.StatusOK {
+		errorMsgAndQuit(res, exitServer)
 	}
 }
 
-func checkArity(args [] string, nb int, c Command) {
+func checkArity(args []string, nb int, c Command) {
 	if len(args) != nb {
 		fmt.Fprintf(os.Stderr, "Missing parameter(s). 'bip help %s' to help\n", c.Id)
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 }
 
 func Done(args []string) {
 	checkArity(args, 1, commands["done"])
 	id := args[0]
-	req, err := http.NewRequest("PUT", remote + "/jobs/" + id + "/status?s=terminating", nil)
-	if (err != nil) {
+	req, err := http.NewRequest("PUT", remote+"/jobs/"+id+"/status?s=terminating", nil)
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
-		os.Exit(-1)
+		os.Exit(exitNetwork)
 	}
 	res, err := http.DefaultClient.Do(req)
-	if (err != nil) {
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to submit the request: %s\n", err)
-		os.Exit(-1)
+		os.Exit(exitNetwork)
 	}
-	if (res.StatusCode != http.StatusOK) {
-		errorMsgAndQuit(res, 2)
+	if res.StatusCode != http.StatusOK {
+		errorMsgAndQuit(res, exitServer)
 	}
 }
 
+func Fail(args []string) {
+	checkArity(args, 1, commands["fail"])
+	id := args[0]
+	req, err := http.NewRequest("PUT", remote+"/jobs/"+id+"/status?s=failed", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(exitNetwork)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to submit the request: %s\n", err)
+		os.Exit(exitNetwork)
+	}
+	if res.StatusCode != http.StatusOK {
+		errorMsgAndQuit(res, exitServer)
+	}
+}
+
+func GC(args []string) {
+	flagSet := flag.NewFlagSet("", 0)
+	dryRun := flagSet.Bool("dry-run", false, "")
+	toJSON := flagSet.Bool("to-json", false, "")
+	flagSet.Parse(args)
+	u := remote + "/gc"
+	if *dryRun {
+		u += "?dry_run=1"
+	}
+	res, err := http.Post(u, "", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to submit the request: %s\n", err)
+		os.Exit(exitNetwork)
+	}
+	if res.StatusCode != http.StatusOK {
+		errorMsgAndQuit(res, exitServer)
+	}
+	cnt, _ := ioutil.ReadAll(res.Body)
+	if *toJSON {
+		fmt.Printf("%s", cnt)
+		return
+	}
+	var c bip.Collection
+	json.Unmarshal(cnt, &c)
+	for _, x := range c.Jobs {
+		fmt.Printf("%s\t%s\t%d\t%s", x.Id, x.Status, x.Size, x.Reason)
+		if x.Archive != "" {
+			fmt.Printf("\t%s", x.Archive)
+		}
+		fmt.Printf("\n")
+	}
+	if c.DryRun {
+		fmt.Printf("%d job(s) to remove, %d byte(s) to reclaim\n", len(c.Jobs), c.Bytes)
+	} else {
+		fmt.Printf("%d job(s) removed, %d byte(s) reclaimed\n", len(c.Jobs), c.Bytes)
+	}
+}
+
+func Archive(args []string) {
+	checkArity(args, 1, commands["archive"])
+	res, err := http.Post(remote+"/jobs/"+args[0]+"/archive", "", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to submit the request: %s\n", err)
+		os.Exit(exitNetwork)
+	}
+	if res.StatusCode != http.StatusOK {
+		errorMsgAndQuit(res, exitServer)
+	}
+	var a bip.Archived
+	json.NewDecoder(res.Body).Decode(&a)
+	fmt.Printf("%s\n", a.Path)
+}
+
+func Restore(args []string) {
+	checkArity(args, 1, commands["restore"])
+	res, err := http.Post(remote+"/archive/"+args[0]+"/restore", "", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to submit the request: %s\n", err)
+		os.Exit(exitNetwork)
+	}
+	if res.StatusCode != http.StatusOK {
+		errorMsgAndQuit(res, exitServer)
+	}
+}
+
+func ListArchived(args []string) {
+	flagSet := flag.NewFlagSet("", 0)
+	toJSON := flagSet.Bool("to-json", false, "")
+	label := flagSet.String("l", "", "")
+	status := flagSet.String("s", "", "")
+	flagSet.Parse(args)
+	cnt := get("/archive/?l=" + url.QueryEscape(*label) + "&s=" + url.QueryEscape(*status))
+	if *toJSON {
+		fmt.Printf("%s", cnt)
+		return
+	}
+	var entries []bip.Archived
+	json.Unmarshal(cnt, &entries)
+	for _, a := range entries {
+		fmt.Printf("%s\t%s\t%s\t%s\n", a.Id, a.Status, a.ArchivedAt.Local().Format("2006-01-02 15:04:05"), a.Path)
+	}
+}
+
+func Snapshot(args []string) {
+	flagSet := flag.NewFlagSet("", 0)
+	output := flagSet.String("o", "", "")
+	flagSet.Parse(args)
+	res, err := http.Get(remote + "/snapshot")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error while sending the request: %s\n", err)
+		os.Exit(exitNetwork)
+	}
+	if res.StatusCode != http.StatusOK {
+		errorMsgAndQuit(res, exitServer)
+	}
+	defer res.Body.Close()
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(exitUsage)
+		}
+		defer out.Close()
+	}
+	//A snapshot interrupted on the server side is a truncated gzip stream
+	if _, err = io.Copy(out, res.Body); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to get the snapshot: %s\n", err)
+		os.Exit(exitServer)
+	}
+}
+
+// metadata collects the 'key=value' pairs of a repeated flag.
+type metadata map[string]string
+
+func (m metadata) String() string {
+	return fmt.Sprintf("%v", map[string]string(m))
+}
+
+func (m metadata) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("expected 'key=value', got '%s'", s)
+	}
+	m[kv[0]] = kv[1]
+	return nil
+}
 
 func PutResult(args []string) {
-	checkArity(args, 2, commands["rput"])
-	id := args[0]
-	r := args[1]
-	res, err := http.Post(remote + "/jobs/" + id + "/results/?r=" + r, "", os.Stdin)
-	if (err != nil) {
+	flagSet := flag.NewFlagSet("", 0)
+	contentType := flagSet.String("type", "", "")
+	filename := flagSet.String("name", "", "")
+	dir := flagSet.String("r", "", "")
+	meta := make(metadata)
+	flagSet.Var(meta, "meta", "")
+	flagSet.Parse(args)
+	if *dir != "" {
+		//Upload every file of the directory, named after its relative path
+		checkArity(flagSet.Args(), 1, commands["rput"])
+		id := flagSet.Args()[0]
+		err := filepath.Walk(*dir, func(p string, stat os.FileInfo, err error) error {
+			if err != nil || !stat.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(*dir, p)
+			if err != nil {
+				return err
+			}
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			putResult(id, filepath.ToSlash(rel), f, *contentType, stat.Name(), meta)
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read '%s': %s\n", *dir, err)
+			os.Exit(1)
+		}
+		return
+	}
+	checkArity(flagSet.Args(), 2, commands["rput"])
+	putResult(flagSet.Args()[0], flagSet.Args()[1], os.Stdin, *contentType, *filename, meta)
+}
+
+// resultPath returns the path of a result on the server. The job
+// identifier and each segment of the result name are escaped.
+func resultPath(id, r string) string {
+	segs := strings.Split(r, "/")
+	for i, x := range segs {
+		segs[i] = url.PathEscape(x)
+	}
+	return "/jobs/" + url.PathEscape(id) + "/results/" + strings.Join(segs, "/")
+}
+
+func putResult(id, r string, src io.Reader, contentType, filename string, meta metadata) {
+	in := bufio.NewReader(src)
+	if contentType == "" {
+		//Sniff the content type from the first bytes
+		head, _ := in.Peek(512)
+		contentType = http.DetectContentType(head)
+	}
+	u := remote + "/jobs/" + url.PathEscape(id) + "/results/?r=" + url.QueryEscape(r)
+	if filename != "" {
+		u += "&f=" + url.QueryEscape(filename)
+	}
+	req, err := http.NewRequest("POST", u, in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(exitNetwork)
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range meta {
+		req.Header.Set("X-Bip-Meta-"+k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to submit the request: %s\n", err)
-		os.Exit(-1)
+		os.Exit(exitNetwork)
 	}
-	if (res.StatusCode != http.StatusCreated) {
-		errorMsgAndQuit(res, 2)
+	if res.StatusCode != http.StatusCreated {
+		errorMsgAndQuit(res, exitServer)
 	}
 }
 
 func get(url string) []byte {
 	res, err := http.Get(remote + url)
-	if (err != nil) {
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error while sending the request: %s\n", err)
-		os.Exit(-1)
+		os.Exit(exitNetwork)
 	}
-	if (res.StatusCode == http.StatusOK) {
+	if res.StatusCode == http.StatusOK {
 		cnt, _ := ioutil.ReadAll(res.Body)
 		return cnt
 	} else {
-		errorMsgAndQuit(res, 2)
+		errorMsgAndQuit(res, exitServer)
 	}
 	return nil
 }
 
 func Data(args []string) {
 	checkArity(args, 1, commands["data"])
-	fmt.Printf("%s",get("/jobs/" + args[0] + "/data"))
+	fmt.Printf("%s", get("/jobs/"+args[0]+"/data"))
 }
 
 func Status(args []string) {
 	checkArity(args, 1, commands["status"])
-	fmt.Printf("%s",get("/jobs/" + args[0] + "/status"))
+	fmt.Printf("%s", get("/jobs/"+args[0]+"/status"))
 }
 
 func GetJob(args []string) {
 	flagSet := flag.NewFlagSet("", 0)
 	toJSON := flagSet.Bool("to-json", false, "")
-	withStatus :=  flagSet.Bool("with-status", false, "")
+	withStatus := flagSet.Bool("with-status", false, "")
 	flagSet.Parse(args)
 	checkArity(flagSet.Args(), 1, commands["get"])
 	cnt := get("/jobs/" + flagSet.Args()[0])
 	if !*toJSON {
-		var js interface {}
+		var js interface{}
 		json.Unmarshal(cnt, &js)
-		job := js.(map[string]interface {})
-			if !*withStatus {
-				fmt.Printf("%s\n", job["id"])
-			} else {
-				fmt.Printf("%s\t%s\n", job["id"], job["status"])
-			}
+		job := js.(map[string]interface{})
+		if !*withStatus {
+			fmt.Printf("%s\n", job["id"])
+		} else if p, ok := job["progress"].(map[string]interface{}); ok && (job["status"] == "processing" || job["status"] == "terminating") {
+			fmt.Printf("%s\t%s\t%v%%\t%s\n", job["id"], job["status"], p["percent"], p["message"])
+		} else {
+			fmt.Printf("%s\t%s\n", job["id"], job["status"])
+		}
 	} else {
 		fmt.Printf("%s", cnt)
 	}
 }
 
 func Result(args []string) {
-	checkArity(args, 2, commands["rget"])
-	fmt.Printf("%s", get("/jobs/" + args[0] + "/results/" + args[1]))
+	flagSet := flag.NewFlagSet("", 0)
+	all := flagSet.Bool("all", false, "")
+	output := flagSet.String("o", ".", "")
+	label := flagSet.String("l", "", "")
+	status := flagSet.String("s", "", "")
+	flagSet.Parse(args)
+	if !*all {
+		checkArity(flagSet.Args(), 2, commands["rget"])
+		fmt.Printf("%s", get(resultPath(flagSet.Args()[0], flagSet.Args()[1])))
+		return
+	}
+	var u string
+	if len(flagSet.Args()) == 1 {
+		u = "/jobs/" + flagSet.Args()[0] + "/results.tar.gz"
+	} else if len(flagSet.Args()) == 0 && (*label != "" || *status != "") {
+		u = "/results.tar.gz?l=" + url.QueryEscape(*label) + "&s=" + url.QueryEscape(*status)
+	} else {
+		checkArity(flagSet.Args(), 1, commands["rget"])
+	}
+	res, err := http.Get(remote + u)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error while sending the request: %s\n", err)
+		os.Exit(exitNetwork)
+	}
+	if res.StatusCode != http.StatusOK {
+		errorMsgAndQuit(res, exitServer)
+	}
+	defer res.Body.Close()
+	if err = extract(res.Body, *output); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to extract the results: %s\n", err)
+		os.Exit(exitServer)
+	}
+}
+
+func History(args []string) {
+	flagSet := flag.NewFlagSet("", 0)
+	toJSON := flagSet.Bool("to-json", false, "")
+	flagSet.Parse(args)
+	checkArity(flagSet.Args(), 1, commands["history"])
+	cnt := get("/jobs/" + flagSet.Args()[0] + "/history")
+	if *toJSON {
+		fmt.Printf("%s", cnt)
+		return
+	}
+	var entries []bip.AuditEntry
+	json.Unmarshal(cnt, &entries)
+	for _, e := range entries {
+		from := e.From
+		if from == "" {
+			from = "-"
+		}
+		fmt.Printf("%s\t%s\t%s -> %s\n", e.Time.Local().Format("2006-01-02 15:04:05"), e.Who, from, e.To)
+	}
+}
+
+func Stats(args []string) {
+	flagSet := flag.NewFlagSet("", 0)
+	toJSON := flagSet.Bool("to-json", false, "")
+	flagSet.Parse(args)
+	checkArity(flagSet.Args(), 0, commands["stats"])
+	cnt := get("/stats")
+	if *toJSON {
+		fmt.Printf("%s", cnt)
+		return
+	}
+	var st bip.Stats
+	json.Unmarshal(cnt, &st)
+	for _, s := range st.Shares {
+		fmt.Printf("%s\t%d\t%d\t%d\t%d\t%d\n", s.Name, s.Ready, s.Scheduled, s.Running, s.Served, s.Weight)
+	}
+}
+
+func Quotas(args []string) {
+	flagSet := flag.NewFlagSet("", 0)
+	toJSON := flagSet.Bool("to-json", false, "")
+	flagSet.Parse(args)
+	checkArity(flagSet.Args(), 0, commands["quotas"])
+	cnt := get("/quotas")
+	if *toJSON {
+		fmt.Printf("%s", cnt)
+		return
+	}
+	var rep bip.QuotaReport
+	json.Unmarshal(cnt, &rep)
+	for _, x := range []struct {
+		scope  string
+		usages []bip.QuotaUsage
+	}{{"submitter", rep.Submitters}, {"queue", rep.Queues}} {
+		for _, u := range x.usages {
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", x.scope, u.Name, usageOf(int64(u.Jobs), int64(u.MaxJobs)),
+				usageOf(u.Bytes, u.MaxBytes), usageOf(int64(u.Rate), int64(u.MaxRate)))
+		}
+	}
+}
+
+// usageOf formats a usage against its limit, 0 meaning no limit.
+func usageOf(n, max int64) string {
+	if max == 0 {
+		return strconv.FormatInt(n, 10)
+	}
+	return strconv.FormatInt(n, 10) + "/" + strconv.FormatInt(max, 10)
+}
+
+func ReportProgress(args []string) {
+	flagSet := flag.NewFlagSet("", 0)
+	counters := flagSet.String("c", "", "")
+	flagSet.Parse(args)
+	args = flagSet.Args()
+	if len(args) != 3 {
+		checkArity(args, 2, commands["progress"])
+	}
+	q := url.Values{}
+	q.Set("percent", args[1])
+	if len(args) == 3 {
+		q.Set("message", args[2])
+	}
+	if *counters != "" {
+		q.Set("counters", *counters)
+	}
+	do("PUT", remote+"/jobs/"+args[0]+"/progress?"+q.Encode(), nil, http.StatusOK).Body.Close()
+}
+
+func Logs(args []string) {
+	flagSet := flag.NewFlagSet("", 0)
+	follow := flagSet.Bool("f", false, "")
+	attempt := flagSet.String("a", "", "")
+	flagSet.Parse(args)
+	checkArity(flagSet.Args(), 1, commands["logs"])
+	q := url.Values{}
+	if *follow {
+		q.Set("follow", "true")
+	}
+	if *attempt != "" {
+		q.Set("attempt", *attempt)
+	}
+	res := do("GET", remote+"/jobs/"+flagSet.Arg(0)+"/logs?"+q.Encode(), nil, http.StatusOK)
+	defer res.Body.Close()
+	if _, err := io.Copy(os.Stdout, res.Body); err != nil {
+		fmt.Fprintf(os.Stderr, "Error while reading the logs: %s\n", err)
+		os.Exit(exitNetwork)
+	}
+}
+
+func LogsPipe(args []string) {
+	checkArity(args, 1, commands["logs-pipe"])
+	//Without a length, stdin is streamed as it is read
+	do("POST", remote+"/jobs/"+args[0]+"/logs", os.Stdin, http.StatusOK).Body.Close()
 }
 
 func Results(args []string) {
 	checkArity(args, 1, commands["rlist"])
-	fmt.Printf("%s",get("/jobs/" + args[0] + "/results/"))
+	fmt.Printf("%s", get("/jobs/"+args[0]+"/results/"))
+}
+
+// tokenTransport sends a bearer token with every request.
+type tokenTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("authorization", "Bearer "+t.token)
+	return t.next.RoundTrip(r)
+}
+
+// backoffTransport retries the requests refused with 429 or 503 and a
+// 'Retry-After' header, once the delay is over. The requests with a body
+// that cannot be sent again are not retried.
+type backoffTransport struct {
+	retries int
+	next    http.RoundTripper
+}
+
+// Longest delay to wait before a retry.
+const maxBackoff = 2 * time.Minute
+
+func (t *backoffTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	for i := 0; ; i++ {
+		res, err := t.next.RoundTrip(r)
+		if err != nil || i == t.retries || (res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusServiceUnavailable) {
+			return res, err
+		}
+		secs, err := strconv.Atoi(res.Header.Get("Retry-After"))
+		d := time.Duration(secs) * time.Second
+		if err != nil || d > maxBackoff || (r.Body != nil && r.GetBody == nil) {
+			return res, nil
+		}
+		res.Body.Close()
+		if r.GetBody != nil {
+			body, err := r.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = r.Clone(r.Context())
+			r.Body = body
+		}
+		fmt.Fprintf(os.Stderr, "The server is busy, retrying in %s\n", d)
+		time.Sleep(d)
+	}
+}
+
+// serverURL returns the base URL of the server. For a Unix domain
+// socket, the HTTP client is set up to dial the socket.
+func serverURL(s string) string {
+	if strings.HasPrefix(s, "unix://") {
+		socket := strings.TrimPrefix(s, "unix://")
+		http.DefaultClient.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		return "http://unix"
+	}
+	return "http://" + strings.TrimPrefix(s, "http://")
 }
 
 func main() {
 
-	flag.StringVar(&remote, "s", "localhost:6798", "The server to correspond with")
+	flag.StringVar(&remote, "s", "localhost:6798", "The server to correspond with: 'host:port' or 'unix:///path/to/socket'")
+	token := flag.String("t", os.Getenv("BIP_TOKEN"), "The token identifying the client. Default is $BIP_TOKEN")
+	retries := flag.Int("retries", 5, "The number of retries when the server is busy")
 	flag.Parse()
 	commands = make(map[string]Command)
 	commands["list"] = Command{"list", "List the jobs",
-							   "bip [-s server ] list [options]\nAvailable options:\n --to-json: for a json output\n --with-status: to print the jobs status too",
-								ListJobs}
-	commands["put"] = Command{"put", "Declare the job", "bip [-s server ] put id\n id: the job identifier\n The job data are provided from stdin", Put}
-	commands["process"] = Command{"process", "Process a job", "bip [-s server ] process [id]\n id : the job identifier to process. If omitted, a random processable job is choosed", Process}
+		"bip [-s server ] list [options]\nAvailable options:\n --to-json: for a json output\n --with-status: to print the jobs status too",
+		ListJobs}
+	commands["put"] = Command{"put", "Declare the job", "bip [-s server ] put [options] id\n id: the job identifier\n The job data are provided from stdin\nAvailable options:\n -l: comma-separated labels to attach to the job\n --at: keep the job scheduled until this RFC 3339 date, like '2024-03-01T22:00:00Z'\n --in: keep the job scheduled for this delay, like '90s' or '2h'\n --deadline: expire the job if not processed by this RFC 3339 date, or after this delay\n --timeout: the maximum processing duration, like '30m'. Beyond, the job is made ready again or failed\n --retries: how many times the job is made ready again after a timeout. Default is 0\n --resources: the resources the job holds while processed, like 'mem=32GB,cpu=4'\n --constraints: the constraints on the worker attributes, like 'version>=2.3,gpu'", Put}
+	commands["process"] = Command{"process", "Process a job", "bip [-s server ] process [-w worker] [--resources r] [--attributes a] [id]\n id : the job identifier to process. If omitted, a random processable job is choosed\nAvailable options:\n -w: the registered worker processing the job. Default is $BIP_WORKER\n --resources: the resources of the worker, like 'mem=64GB,cpu=16'. Only a job that fits is choosed. Default is $BIP_RESOURCES\n --attributes: the attributes of the worker, like 'version=2.4,gpu', checked against the job constraints. Default is $BIP_ATTRIBUTES", Process}
 	commands["done"] = Command{"done", "Declare a job processing is done", "", Done}
-	commands["rput"] = Command{"rput", "Send a result","", PutResult}
+	commands["rput"] = Command{"rput", "Send a result",
+		"bip [-s server ] rput [options] id r\n id: the job identifier\n r: the result identifier, possibly a path like 'plots/cpu.png'\n The result is provided from stdin\n" +
+			"bip [-s server ] rput [options] -r dir id\n Send every file in 'dir' as a result named after its path relative to 'dir'\nAvailable options:\n --type: the content type of the result. If omitted, it is guessed from the content\n --name: the filename to suggest when the result is downloaded\n --meta key=value: a metadata to attach to the result. Can be repeated",
+		PutResult}
+	commands["fail"] = Command{"fail", "Declare the processing of a job failed", "bip [-s server ] fail id\n id: the job identifier", Fail}
+	commands["gc"] = Command{"gc", "Delete the finished jobs according to the retention rules",
+		"bip [-s server ] gc [options]\n The server must be an administration endpoint. Jobs having the pin label are kept\nAvailable options:\n --dry-run: only print the jobs to delete\n --to-json: for a json output",
+		GC}
 	commands["commit"] = Command{"commit", "Declare a job has been processed and all the results sended", "", Commit}
-	commands["get"] = Command{"get", "Get a job summary", " --to-json: for a json output\n --with-status: to print the jobs status too", GetJob}
+	commands["get"] = Command{"get", "Get a job summary", " --to-json: for a json output\n --with-status: to print the jobs status too, and the last progress of a job being processed", GetJob}
+	commands["progress"] = Command{"progress", "Report the progress of a job being processed",
+		"bip [-s server ] progress [-c counters] id percent [message]\n id: the job identifier\n percent: the completion, between 0 and 100\n message: a free-form message, like 'step 3/7'\nAvailable options:\n -c: comma-separated counters, like 'files=12,bytes=3MB'",
+		ReportProgress}
+	commands["logs"] = Command{"logs", "Get the logs of a job",
+		"bip [-s server ] logs [-f] [-a attempt] id\n id: the job identifier\nAvailable options:\n -f: follow the logs as they are appended, until the attempt is over\n -a: the processing attempt. Default is the last one having logs",
+		Logs}
+	commands["logs-pipe"] = Command{"logs-pipe", "Append stdin to the logs of a job being processed",
+		"bip [-s server ] logs-pipe id\n id: the job identifier\n stdin is streamed to the logs of the current attempt until it is closed, like with 'cmd 2>&1 | bip logs-pipe id'",
+		LogsPipe}
 	commands["status"] = Command{"status", "Get a job status", "", Status}
-	commands["data"] = Command{"data", "Get a job data", "",Data}
+	commands["data"] = Command{"data", "Get a job data", "", Data}
 	commands["rlist"] = Command{"rlist", "Get the results identifier of a processed job", " --to-json: for a json output", Results}
-	commands["rget"] = Command{"rget", "Get a specific results for a processed job", "",Result}
-	commands["help"] = Command{"help", "Print this help or the usage of a specific command", "",Usage}
+	commands["rget"] = Command{"rget", "Get a specific results for a processed job",
+		"bip [-s server ] rget id r\n id: the job identifier\n r: the result identifier\n" +
+			"bip [-s server ] rget --all [-o dir] [-l label] [-s status] [id]\n Extract all the results of a job, or of the jobs having the given label and status\n" +
+			"Available options:\n -o: the output directory. Default is the current directory\n -l: the label of the jobs\n -s: the status of the jobs",
+		Result}
+	commands["history"] = Command{"history", "Get the status changes of a job", "bip [-s server ] history [--to-json] id\n id: the job identifier\n Print when the job changed its status, and who asked for it\nAvailable options:\n --to-json: for a json output", History}
+	commands["archive"] = Command{"archive", "Move a terminated, failed or expired job to the archive", "bip [-s server ] archive id\n id: the job identifier\n Print the path of the archive", Archive}
+	commands["restore"] = Command{"restore", "Restore an archived job", "bip [-s server ] restore id\n id: the job identifier", Restore}
+	commands["archived"] = Command{"archived", "List the archived jobs",
+		"bip [-s server ] archived [options]\nAvailable options:\n -l: the label of the jobs\n -s: the status of the jobs\n --to-json: for a json output",
+		ListArchived}
+	commands["snapshot"] = Command{"snapshot", "Get a consistent snapshot of the server store",
+		"bip [-s server ] snapshot [-o file]\n The server must be an administration endpoint. 'bipd restore' rebuilds a store from the snapshot\nAvailable options:\n -o: the output file. Default is stdout",
+		Snapshot}
+	commands["export"] = Command{"export", "Export jobs with their data and results",
+		"bip [-s server ] export [options] [id...]\n id: the jobs to export. If omitted, every job is exported\n The export is a tar stream with a description of each job, its data and its results\nAvailable options:\n -o: the output file. Default is stdout\n -l: only export the jobs having this label\n -s: only export the jobs having this status",
+		Export}
+	commands["import"] = Command{"import", "Import jobs exported by 'bip export'",
+		"bip [-s server ] import [options] [file]\n file: the export, possibly compressed with gzip. Default is stdin\n Print the identifier of each job on the server and its status\nAvailable options:\n --on-conflict: when a job identifier is used, 'skip' the job, 'rename' it with a numeric suffix or 'overwrite' the existing job. Default is 'skip'\n --reset: import the jobs as ready, without their results, rather than with their status",
+		Import}
+	commands["cron"] = Command{"cron", "Manage the recurring jobs",
+		"bip [-s server ] cron [list [--to-json]]\n Print the name, the schedule, the next run and the last job of each recurring job\n" +
+			"bip [-s server ] cron add [options] name schedule\n name: the name of the recurring job\n schedule: a cron expression like '*/15 * * * *', or '@hourly', '@daily', '@weekly', '@monthly', '@yearly'\n The template of the job data is provided from stdin. The templates can use {{.Name}}, {{.Time}} for the moment of the run and {{.Seq}} for its number\n" +
+			"bip [-s server ] cron get name\n Print the recurring job in json\n" +
+			"bip [-s server ] cron rm name\n Delete the recurring job. The spawned jobs are kept\n" +
+			"Available options:\n -l: comma-separated labels to attach to the jobs\n --id: the template of the job identifiers. Default is '{{.Name}}-{{.Time.Format \"20060102-1504\"}}'\n --overlap: when the previous job is not finished, 'skip' the run, 'allow' it, or 'cancel' the previous job. Default is 'skip'\n --catch-up: the runs missed while the server was down to spawn: 'none', the 'last' one or 'all'. Default is 'none'",
+		Cron}
+	commands["workers"] = Command{"workers", "List the workers and the jobs they are processing",
+		"bip [-s server ] workers [--to-json]\n Print the name, the host, the state, the last heartbeat, the jobs and the number of completed and failed jobs of each worker\nAvailable options:\n --to-json: for a json output",
+		ListWorkers}
+	commands["worker"] = Command{"worker", "Register a worker and declare it is alive",
+		"bip [-s server ] worker register [options] name\n Register the worker, or update its description\n" +
+			"bip [-s server ] worker heartbeat name\n Declare the worker is alive\n" +
+			"bip [-s server ] worker unregister name\n" +
+			"Available options:\n --host: the host of the worker. Default is the local host name\n -l: comma-separated labels describing the capabilities of the worker\n --max: the maximum number of jobs processed at once. Default is 0, for no limit",
+		Worker}
+	commands["stats"] = Command{"stats", "Get the jobs per submitter, or per label",
+		"bip [-s server ] stats [--to-json]\n Print the name, the number of ready, scheduled and running jobs, the number of jobs handed out and the weight of each share of the fair share scheduling\nAvailable options:\n --to-json: for a json output",
+		Stats}
+	commands["quotas"] = Command{"quotas", "Get the usage of the submitters and of the queues against their quotas",
+		"bip [-s server ] quotas [--to-json]\n Print the scope, the name, the number of jobs, the stored bytes and the submissions per minute of each submitter and queue, against their quota if any\nAvailable options:\n --to-json: for a json output",
+		Quotas}
+	commands["help"] = Command{"help", "Print this help or the usage of a specific command", "", Usage}
 
-	if (len(flag.Args()) == 0) {
+	if len(flag.Args()) == 0 {
 		Usage(flag.Args())
-		os.Exit(1)
+		os.Exit(exitUsage)
+	}
+	remote = serverURL(remote) + "/v1"
+	if *token != "" {
+		next := http.DefaultClient.Transport
+		if next == nil {
+			next = http.DefaultTransport
+		}
+		http.DefaultClient.Transport = &tokenTransport{*token, next}
+	}
+	if *retries > 0 {
+		next := http.DefaultClient.Transport
+		if next == nil {
+			next = http.DefaultTransport
+		}
+		http.DefaultClient.Transport = &backoffTransport{*retries, next}
 	}
-	remote = "http://" + remote
 	cmd, ok := commands[flag.Args()[0]]
 	if !ok {
 		fmt.Fprintf(os.Stderr, "Unknown command '%s'. 'bip help' for help\n", os.Args[2])
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 
 	cmd.Fn(flag.Args()[1:])
@@ -269,17 +887,20 @@ func main() {
 
 func Usage(args []string) {
 	if len(args) == 0 {
-		fmt.Fprintf(os.Stderr, "Usage: 'bip [-s server] command'\n")
-		fmt.Fprintf(os.Stderr, "server: the server and port to correspond with.\n")
+		fmt.Fprintf(os.Stderr, "Usage: 'bip [-s server] [-t token] [-retries n] command'\n")
+		fmt.Fprintf(os.Stderr, "server: the server and port to correspond with, or 'unix:///path/to/socket'.\n")
+		fmt.Fprintf(os.Stderr, "token: the token identifying the client. Default is $BIP_TOKEN.\n")
+		fmt.Fprintf(os.Stderr, "n: the number of retries when the server asks to retry later. Default is 5.\n")
 		fmt.Fprintf(os.Stderr, "Available commands:\n")
 		for k, cmd := range commands {
 			fmt.Fprintf(os.Stderr, " %s - %s\n", k, cmd.ShortHelp)
 		}
+		fmt.Fprintf(os.Stderr, "%s", exitCodesHelp)
 	} else {
 		cmd, ok := commands[args[0]]
 		if !ok {
 			fmt.Fprintf(os.Stderr, "Unknown command '%s'. 'bip help' for help\n", os.Args[2])
-			os.Exit(1)
+			os.Exit(exitUsage)
 		}
 		fmt.Fprintf(os.Stderr, "%s\nUsage: %s\n", cmd.ShortHelp, cmd.LongHelp)
 	}
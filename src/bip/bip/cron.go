@@ -0,0 +1,82 @@
+/**
+ *
+ * Management of the recurring jobs.
+ * @author Fabien Hermenier
+ */
+package main
+
+import (
+	"bip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+func Cron(args []string) {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch args[0] {
+	case "list":
+		listCrons(args[1:])
+	case "add":
+		addCron(args[1:])
+	case "get":
+		checkArity(args[1:], 1, commands["cron"])
+		fmt.Printf("%s", get("/cron/"+args[1]))
+	case "rm":
+		checkArity(args[1:], 1, commands["cron"])
+		do("DELETE", remote+"/cron/"+args[1], nil, http.StatusOK).Body.Close()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown sub-command '%s'. 'bip help cron' to help\n", args[0])
+		os.Exit(exitUsage)
+	}
+}
+
+func listCrons(args []string) {
+	flagSet := flag.NewFlagSet("", 0)
+	toJSON := flagSet.Bool("to-json", false, "")
+	flagSet.Parse(args)
+	cnt := get("/cron/")
+	if *toJSON {
+		fmt.Printf("%s", cnt)
+		return
+	}
+	var crons []bip.Cron
+	json.Unmarshal(cnt, &crons)
+	for _, c := range crons {
+		next := "-"
+		if c.Next != nil {
+			next = c.Next.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\n", c.Name, c.Schedule, next, c.LastJob)
+	}
+}
+
+func addCron(args []string) {
+	flagSet := flag.NewFlagSet("", 0)
+	labels := flagSet.String("l", "", "")
+	id := flagSet.String("id", "", "")
+	overlap := flagSet.String("overlap", "", "")
+	catchUp := flagSet.String("catch-up", "", "")
+	flagSet.Parse(args)
+	checkArity(flagSet.Args(), 2, commands["cron"])
+	q := url.Values{}
+	q.Set("name", flagSet.Arg(0))
+	q.Set("schedule", flagSet.Arg(1))
+	for k, v := range map[string]string{"l": *labels, "id": *id, "overlap": *overlap, "catch_up": *catchUp} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	do("POST", remote+"/cron/?"+q.Encode(), os.Stdin, http.StatusCreated).Body.Close()
+	var c bip.Cron
+	json.Unmarshal(get("/cron/"+flagSet.Arg(0)), &c)
+	if c.Next != nil {
+		fmt.Printf("next run: %s\n", c.Next.Local().Format(time.RFC1123))
+	}
+}
@@ -0,0 +1,84 @@
+/**
+ *
+ * Extraction of results archives.
+ * @author Fabien Hermenier
+ */
+package main
+
+import (
+	"archive/tar"
+	"bip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// extract unpacks a gzipped results archive into a directory, then
+// checks the extracted files against the manifest.
+func extract(in io.Reader, dir string) error {
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	sums := make(map[string]string)
+	var manifest []bip.ManifestEntry
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if hdr.Name == bip.ManifestName {
+			cnt, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			if err = json.Unmarshal(cnt, &manifest); err != nil {
+				return err
+			}
+			continue
+		}
+		rel := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			return fmt.Errorf("Illegal path '%s' in the archive", hdr.Name)
+		}
+		path := filepath.Join(dir, rel)
+		if sums[hdr.Name], err = extractFile(tr, path); err != nil {
+			return err
+		}
+	}
+	if manifest == nil {
+		return fmt.Errorf("Missing manifest in the archive")
+	}
+	for _, e := range manifest {
+		if sums[e.Path] != e.SHA256 {
+			return fmt.Errorf("Checksum mismatch for '%s'", e.Path)
+		}
+	}
+	return nil
+}
+
+func extractFile(in io.Reader, path string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(f, h), in); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,367 @@
+/**
+ *
+ * Export and import of jobs between servers.
+ * @author Fabien Hermenier
+ */
+package main
+
+import (
+	"archive/tar"
+	"bip"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Name of the first entry of an export, which describes it.
+const exportHeaderName = "bip-export.json"
+
+// exportHeader describes an export.
+type exportHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Jobs    []string  `json:"jobs"`
+}
+
+// exportedJob describes a job of an export. It is followed by the data
+// of the job in '<id>/data' and its results in '<id>/results/'.
+type exportedJob struct {
+	Id           string                `json:"id"`
+	Status       string                `json:"status"`
+	Labels       []string              `json:"labels"`
+	NotBefore    time.Time             `json:"not_before,omitempty"`
+	Deadline     time.Time             `json:"deadline,omitempty"`
+	Timeout      string                `json:"timeout,omitempty"`
+	Retries      int                   `json:"retries,omitempty"`
+	Requirements *bip.Requirements     `json:"requirements,omitempty"`
+	Results      map[string]bip.Result `json:"results"`
+	//Who submitted the job, how many times it was processed, and when it
+	//entered its status
+	Submitter string    `json:"submitter,omitempty"`
+	Attempts  int       `json:"attempts,omitempty"`
+	Since     time.Time `json:"since,omitempty"`
+}
+
+// do sends a request and returns the response when the status code is
+// the expected one. Otherwise, the error is reported and bip exits.
+func do(method, u string, body io.Reader, expected int) *http.Response {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(exitNetwork)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to submit the request: %s\n", err)
+		os.Exit(exitNetwork)
+	}
+	if res.StatusCode != expected {
+		errorMsgAndQuit(res, exitServer)
+	}
+	return res
+}
+
+// selectJobs returns the identifiers of the given jobs, or of every job,
+// having the given label and status.
+func selectJobs(ids []string, label, status string) []string {
+	var jobs []exportedJob
+	json.Unmarshal(get("/jobs/"), &jobs)
+	wanted := make(map[string]bool)
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	res := make([]string, 0)
+	for _, j := range jobs {
+		if len(ids) > 0 && !wanted[j.Id] {
+			continue
+		}
+		delete(wanted, j.Id)
+		if status != "" && j.Status != status {
+			continue
+		}
+		if label != "" && !hasLabel(j.Labels, label) {
+			continue
+		}
+		res = append(res, j.Id)
+	}
+	for id := range wanted {
+		fmt.Fprintf(os.Stderr, "Job '%s' not found\n", id)
+		os.Exit(exitNotFound)
+	}
+	return res
+}
+
+func hasLabel(labels []string, l string) bool {
+	for _, x := range labels {
+		if x == l {
+			return true
+		}
+	}
+	return false
+}
+
+func Export(args []string) {
+	flagSet := flag.NewFlagSet("", 0)
+	output := flagSet.String("o", "", "")
+	label := flagSet.String("l", "", "")
+	status := flagSet.String("s", "", "")
+	flagSet.Parse(args)
+	ids := selectJobs(flagSet.Args(), *label, *status)
+	out := os.Stdout
+	if *output != "" {
+		var err error
+		if out, err = os.Create(*output); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(exitUsage)
+		}
+		defer out.Close()
+	}
+	tw := tar.NewWriter(out)
+	h := exportHeader{"bip-export", 1, time.Now().UTC(), ids}
+	cnt, _ := json.MarshalIndent(h, "", " ")
+	writeEntry(tw, exportHeaderName, int64(len(cnt)), strings.NewReader(string(cnt)))
+	for _, id := range ids {
+		var j exportedJob
+		json.Unmarshal(get("/jobs/"+url.PathEscape(id)+"?details=true"), &j)
+		cnt, _ = json.MarshalIndent(j, "", " ")
+		writeEntry(tw, id+"/job.json", int64(len(cnt)), strings.NewReader(string(cnt)))
+		data := get("/jobs/" + url.PathEscape(id) + "/data")
+		writeEntry(tw, id+"/data", int64(len(data)), strings.NewReader(string(data)))
+		for r, info := range j.Results {
+			res := do("GET", remote+resultPath(id, r), nil, http.StatusOK)
+			writeEntry(tw, id+"/results/"+r, info.Size, res.Body)
+			res.Body.Close()
+		}
+	}
+	if err := tw.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write the export: %s\n", err)
+		os.Exit(exitUsage)
+	}
+}
+
+func writeEntry(tw *tar.Writer, name string, size int64, in io.Reader) {
+	hdr := &tar.Header{Name: name, Mode: 0600, Size: size, ModTime: time.Now(), Typeflag: tar.TypeReg}
+	err := tw.WriteHeader(hdr)
+	if err == nil {
+		_, err = io.Copy(tw, in)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write '%s': %s\n", name, err)
+		os.Exit(exitUsage)
+	}
+}
+
+// importer replays the jobs of an export.
+type importer struct {
+	onConflict string
+	reset      bool
+	//The job being imported, its identifier on the server, and if it is skipped
+	job     *exportedJob
+	target  string
+	skipped bool
+}
+
+// exists indicates if a job identifier is used on the server, by a live
+// or an archived job.
+func exists(id string) (used bool, archived bool) {
+	res, err := http.Get(remote + "/jobs/" + url.PathEscape(id))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to submit the request: %s\n", err)
+		os.Exit(exitNetwork)
+	}
+	res.Body.Close()
+	return res.StatusCode == http.StatusOK || res.StatusCode == http.StatusGone, res.StatusCode == http.StatusGone
+}
+
+func setStatus(id, s string) {
+	do("PUT", remote+"/jobs/"+url.PathEscape(id)+"/status?s="+s, nil, http.StatusOK).Body.Close()
+}
+
+// begin decides the identifier of a job on the server.
+func (im *importer) begin(j *exportedJob) {
+	im.job = j
+	im.target = j.Id
+	im.skipped = false
+	used, archived := exists(j.Id)
+	if !used {
+		return
+	}
+	switch {
+	case im.onConflict == "rename":
+		for i := 1; used; i++ {
+			im.target = j.Id + "-" + strconv.Itoa(i)
+			used, _ = exists(im.target)
+		}
+	case im.onConflict == "overwrite" && !archived:
+		do("DELETE", remote+"/jobs/"+url.PathEscape(j.Id), nil, http.StatusOK).Body.Close()
+	case archived:
+		//An archived job is not overwritten, it must be restored first
+		im.skipped = true
+		fmt.Printf("%s\tskipped, archived\n", j.Id)
+	default:
+		im.skipped = true
+		fmt.Printf("%s\tskipped\n", j.Id)
+	}
+}
+
+// status is the status to give to the job being imported.
+func (im *importer) status() string {
+	if im.reset {
+		return "ready"
+	}
+	return im.job.Status
+}
+
+// create submits the job, then brings it to its status. Results are
+// only accepted while the job is terminating.
+func (im *importer) create(data io.Reader) {
+	u := remote + "/jobs/?j=" + url.QueryEscape(im.target)
+	//The job stays attributed to its submitter rather than to the importer
+	if im.job.Submitter != "" {
+		u += "&submitter=" + url.QueryEscape(im.job.Submitter)
+	}
+	if len(im.job.Labels) > 0 {
+		u += "&l=" + url.QueryEscape(strings.Join(im.job.Labels, ","))
+	}
+	if im.status() == "scheduled" {
+		u += "&not_before=" + url.QueryEscape(im.job.NotBefore.Format(time.RFC3339))
+	}
+	//The deadline only matters until the job is processed. An expired job
+	//expires again once imported
+	if s := im.status(); !im.job.Deadline.IsZero() && (s == "ready" || s == "scheduled" || s == "expired") {
+		u += "&deadline=" + url.QueryEscape(im.job.Deadline.Format(time.RFC3339))
+	}
+	if im.job.Timeout != "" {
+		u += "&timeout=" + url.QueryEscape(im.job.Timeout) + "&retries=" + strconv.Itoa(im.job.Retries)
+	}
+	if r := im.job.Requirements; r != nil {
+		u += "&resources=" + url.QueryEscape(bip.FormatQuantities(r.Resources))
+		cs := make([]string, 0, len(r.Constraints))
+		for _, c := range r.Constraints {
+			cs = append(cs, c.String())
+		}
+		u += "&constraints=" + url.QueryEscape(strings.Join(cs, ","))
+	}
+	do("POST", u, data, http.StatusCreated).Body.Close()
+	switch im.status() {
+	case "processing":
+		setStatus(im.target, "processing")
+	case "terminating", "terminated":
+		setStatus(im.target, "processing")
+		setStatus(im.target, "terminating")
+	case "failed":
+		setStatus(im.target, "processing")
+		setStatus(im.target, "failed")
+	}
+}
+
+// end terminates the job once its results are imported.
+func (im *importer) end() {
+	if im.job == nil || im.skipped {
+		return
+	}
+	if im.status() == "terminated" {
+		setStatus(im.target, "terminated")
+	}
+	fmt.Printf("%s\t%s\t%s\n", im.job.Id, im.target, im.status())
+}
+
+func Import(args []string) {
+	flagSet := flag.NewFlagSet("", 0)
+	onConflict := flagSet.String("on-conflict", "skip", "")
+	reset := flagSet.Bool("reset", false, "")
+	flagSet.Parse(args)
+	if *onConflict != "skip" && *onConflict != "rename" && *onConflict != "overwrite" {
+		fmt.Fprintf(os.Stderr, "Unsupported conflict policy '%s'. 'bip help import' to help\n", *onConflict)
+		os.Exit(exitUsage)
+	}
+	var in io.Reader = os.Stdin
+	if flagSet.NArg() == 1 && flagSet.Arg(0) != "-" {
+		f, err := os.Open(flagSet.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(exitUsage)
+		}
+		defer f.Close()
+		in = f
+	}
+	//Compressed exports are accepted as well
+	buf := bufio.NewReader(in)
+	if magic, _ := buf.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(exitUsage)
+		}
+		in = gz
+	} else {
+		in = buf
+	}
+	tr := tar.NewReader(in)
+	im := &importer{onConflict: *onConflict, reset: *reset}
+	first := true
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid export: %s\n", err)
+			os.Exit(exitUsage)
+		}
+		if first {
+			var h exportHeader
+			if hdr.Name != exportHeaderName || json.NewDecoder(tr).Decode(&h) != nil || h.Format != "bip-export" {
+				fmt.Fprintf(os.Stderr, "Invalid export: no '%s' header\n", exportHeaderName)
+				os.Exit(exitUsage)
+			}
+			first = false
+			continue
+		}
+		id, name := splitEntry(hdr.Name)
+		switch {
+		case name == "job.json":
+			im.end()
+			var j exportedJob
+			if err = json.NewDecoder(tr).Decode(&j); err != nil || j.Id != id {
+				fmt.Fprintf(os.Stderr, "Invalid export: '%s'\n", hdr.Name)
+				os.Exit(exitUsage)
+			}
+			im.begin(&j)
+		case im.job == nil || id != im.job.Id:
+			fmt.Fprintf(os.Stderr, "Invalid export: unexpected '%s'\n", hdr.Name)
+			os.Exit(exitUsage)
+		case im.skipped:
+		case name == "data":
+			im.create(tr)
+		case strings.HasPrefix(name, "results/"):
+			if im.reset {
+				//Ready jobs have no results
+				continue
+			}
+			r := strings.TrimPrefix(name, "results/")
+			info := im.job.Results[r]
+			putResult(im.target, r, tr, info.ContentType, info.Filename, metadata(info.Metadata))
+		}
+	}
+	im.end()
+}
+
+// splitEntry splits the name of an entry into the job identifier and
+// the path inside the job.
+func splitEntry(name string) (string, string) {
+	i := strings.Index(name, "/")
+	if i < 0 {
+		return name, ""
+	}
+	return name[:i], name[i+1:]
+}
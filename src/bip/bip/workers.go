@@ -0,0 +1,76 @@
+/**
+ *
+ * Registration and listing of the workers.
+ * @author Fabien Hermenier
+ */
+package main
+
+import (
+	"bip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func ListWorkers(args []string) {
+	flagSet := flag.NewFlagSet("", 0)
+	toJSON := flagSet.Bool("to-json", false, "")
+	flagSet.Parse(args)
+	cnt := get("/workers/")
+	if *toJSON {
+		fmt.Printf("%s", cnt)
+		return
+	}
+	var workers []bip.Worker
+	json.Unmarshal(cnt, &workers)
+	for _, w := range workers {
+		state := "alive"
+		if w.Stale {
+			state = "stale"
+		}
+		jobs := strings.Join(w.Jobs, ",")
+		if jobs == "" {
+			jobs = "-"
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%d\t%d\n", w.Name, w.Host, state, w.LastSeen.Local().Format("2006-01-02 15:04:05"),
+			jobs, w.Completed, w.Failed)
+	}
+}
+
+func Worker(args []string) {
+	if len(args) == 0 {
+		checkArity(args, 1, commands["worker"])
+	}
+	switch args[0] {
+	case "register":
+		flagSet := flag.NewFlagSet("", 0)
+		host, _ := os.Hostname()
+		flagSet.StringVar(&host, "host", host, "")
+		labels := flagSet.String("l", "", "")
+		max := flagSet.Int("max", 0, "")
+		flagSet.Parse(args[1:])
+		checkArity(flagSet.Args(), 1, commands["worker"])
+		q := url.Values{}
+		q.Set("name", flagSet.Arg(0))
+		q.Set("host", host)
+		q.Set("max", strconv.Itoa(*max))
+		if *labels != "" {
+			q.Set("l", *labels)
+		}
+		do("POST", remote+"/workers/?"+q.Encode(), nil, http.StatusCreated).Body.Close()
+	case "heartbeat":
+		checkArity(args[1:], 1, commands["worker"])
+		do("PUT", remote+"/workers/"+args[1]+"/heartbeat", nil, http.StatusOK).Body.Close()
+	case "unregister":
+		checkArity(args[1:], 1, commands["worker"])
+		do("DELETE", remote+"/workers/"+args[1], nil, http.StatusOK).Body.Close()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown sub-command '%s'. 'bip help worker' to help\n", args[0])
+		os.Exit(exitUsage)
+	}
+}
@@ -8,25 +8,236 @@ package main
 import (
 	"bip"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
 	"os"
-	"log")
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
 
-func main() {
-	port := flag.Int("p", 6798, "Listening port")
-	root := flag.String("r", "./bip_data", "Directory where data are stored")
+var (
+	confPath    = flag.String("c", os.Getenv("BIPD_CONFIG"), "Configuration file")
+	checkConfig = flag.Bool("check-config", false, "Check the configuration and exit")
+	port        = flag.Int("p", 6798, "Listening port. Overrides 'server.listen'")
+	listen      = make(addresses, 0)
+	root        = flag.String("r", "./bip_data", "Directory where data are stored. Overrides 'server.root'")
+	minFree     = flag.String("min-free", "100MB", "Free space required on the storage to be ready. Overrides 'server.min_free_space'")
+	drain       = flag.String("drain", "30s", "Maximum duration to wait for the in-flight requests on shutdown. Overrides 'server.drain_timeout'")
+)
+
+// addresses collects the values of a repeated flag.
+type addresses []string
+
+func (a *addresses) String() string {
+	return strings.Join(*a, ",")
+}
+
+func (a *addresses) Set(s string) error {
+	*a = append(*a, s)
+	return nil
+}
+
+func init() {
+	flag.Var(&listen, "l", "Endpoint to listen on, like 'host:port' or 'unix:///path'. Can be repeated. Overrides 'server.listen'")
+}
+
+// loadConfig reads the configuration file if any, then applies the
+// environment variables and the flags that were set explicitly.
+func loadConfig() (*bip.Config, error) {
+	conf := bip.DefaultConfig()
+	if *confPath != "" {
+		var err error
+		if conf, err = bip.LoadConfig(*confPath); err != nil {
+			return nil, err
+		}
+	}
+	if err := conf.Env(); err != nil {
+		return nil, err
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "p":
+			conf.Server.Listen = []string{":" + strconv.Itoa(*port)}
+		case "l":
+			conf.Server.Listen = listen
+		case "r":
+			conf.Server.Root = *root
+		case "min-free":
+			conf.Server.MinFreeSpace = *minFree
+		case "drain":
+			conf.Server.DrainTimeout = *drain
+		}
+	})
+	return conf, conf.Validate()
+}
 
+// setLogOutput redirects the logs to a file, or the standard error if empty.
+func setLogOutput(c bip.LogConfig) error {
+	if c.File == "" {
+		bip.SetLogOutput(os.Stderr, c.Level)
+		return nil
+	}
+	f, err := os.OpenFile(c.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	bip.SetLogOutput(f, c.Level)
+	return nil
+}
+
+// fatal logs an error and exits.
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// reload reloads the configuration on SIGHUP. The listening address and
+// the storage root cannot change without a restart.
+func reload(current *bip.Config) *bip.Config {
+	conf, err := loadConfig()
+	if err != nil {
+		slog.Error("unable to reload the configuration, keeping the current one", "error", err)
+		return current
+	}
+	if fmt.Sprint(conf.Endpoints()) != fmt.Sprint(current.Endpoints()) || conf.Server.Root != current.Server.Root || conf.Server.ArchiveDir != current.Server.ArchiveDir {
+		slog.Warn("the endpoints, 'server.root' and 'server.archive_dir' are only applied on restart")
+	}
+	if err = setLogOutput(conf.Log); err != nil {
+		slog.Error("unable to open the log file", "file", conf.Log.File, "error", err)
+		conf.Log = current.Log
+	}
+	bip.ApplyConfig(conf)
+	slog.Info("configuration reloaded")
+	return conf
+}
+
+// restore rebuilds the storage root from a snapshot, then checks every
+// job was restored. With -check, the snapshot is restored in a temporary
+// directory that is removed afterwards.
+func restore(conf *bip.Config, args []string) int {
+	flagSet := flag.NewFlagSet("restore", flag.ExitOnError)
+	check := flagSet.Bool("check", false, "Only check the snapshot can be restored")
+	flagSet.Parse(args)
+	if flagSet.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: bipd [-r root] restore [-check] snapshot.tar.gz\n The snapshot is read from stdin if '-'\n")
+		return 1
+	}
+	in := os.Stdin
+	if p := flagSet.Arg(0); p != "-" {
+		f, err := os.Open(p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	root, archive := conf.Server.Root, conf.Server.ArchiveDir
+	if *check {
+		tmp, err := ioutil.TempDir("", "bipd-restore")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 1
+		}
+		defer os.RemoveAll(tmp)
+		root, archive = tmp, ""
+	}
+	m, err := bip.RestoreSnapshot(in, root, archive)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to restore the snapshot: %s\n", err)
+		return 1
+	}
+	if err = bip.VerifySnapshot(m, root, archive); err != nil {
+		fmt.Fprintf(os.Stderr, "Inconsistent restoration: %s\n", err)
+		return 1
+	}
+	if *check {
+		fmt.Printf("Snapshot of %s OK: %d job(s), %d archived job(s)\n", m.Created.Format(time.RFC3339), len(m.Jobs), len(m.Archived))
+	} else {
+		fmt.Printf("Snapshot of %s restored in '%s': %d job(s), %d archived job(s)\n", m.Created.Format(time.RFC3339), root, len(m.Jobs), len(m.Archived))
+	}
+	return 0
+}
+
+func main() {
 	flag.Parse()
+	conf, err := loadConfig()
+	if flag.Arg(0) == "restore" {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(restore(conf, flag.Args()[1:]))
+	}
+	if *checkConfig {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Configuration OK\n")
+		os.Exit(0)
+	}
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if err = setLogOutput(conf.Log); err != nil {
+		fatal("unable to open the log file", "file", conf.Log.File, "error", err)
+	}
+	bip.ApplyConfig(conf)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	//Serve the health checks while the index is loading
+	errs := make(chan error, 1)
+	go func() {
+		errs <- bip.StartREST(conf.Endpoints())
+	}()
+	slog.Info("listening", "endpoints", fmt.Sprint(conf.Endpoints()))
 
-	idx, err := bip.NewIndex(*root)
+	idx, err := bip.NewIndex(conf.Server.Root, conf.Server.ArchiveDir)
 	if err != nil {
-		log.Fatalf("Unable to create the index: %s\n", err)
-		os.Exit(1)
+		fatal("unable to create the index", "root", conf.Server.Root, "error", err)
+	}
+	bip.SetIndex(idx)
+	slog.Info("index loaded", "root", conf.Server.Root, "jobs", len(idx.ListJobs()))
+	idx.StartCollector()
+	idx.StartScheduler()
+
+	for {
+		select {
+		case err = <-errs:
+			fatal("unable to start the REST service", "error", err)
+		case s := <-sigs:
+			if s == syscall.SIGHUP {
+				conf = reload(conf)
+				continue
+			}
+			slog.Info("shutting down", "signal", s.String())
+			os.Exit(shutdown(idx, conf))
+		}
+	}
+}
+
+// shutdown stops serving requests, flushes the index and returns the exit code.
+func shutdown(idx *bip.Index, conf *bip.Config) int {
+	code := 0
+	if err := bip.StopREST(conf.DrainTimeout()); err != nil {
+		pending, _ := bip.Requests()
+		slog.Error("unable to drain the requests", "timeout", conf.DrainTimeout().String(), "interrupted", pending, "error", err)
+		code = 1
 	}
-	log.Printf("Index created in '%s' with %d jobs\n", *root, len(idx.ListJobs()))
-	log.Printf("Listening on %d...\n", *port)
-	err = bip.StartREST(*idx, *port)
-	if (err != nil) {
-		log.Fatalf("Unable to start the Rest service: %s\n", err)
-		os.Exit(1)
+	idx.StopCollector()
+	idx.StopScheduler()
+	if err := idx.Sync(); err != nil {
+		slog.Error("unable to flush the index", "error", err)
+		code = 1
 	}
+	_, served := bip.Requests()
+	slog.Info("stopped", "requests", served, "jobs", idx.CountByStatus())
+	return code
 }
@@ -0,0 +1,392 @@
+/**
+ * Archival of the finished jobs to compressed tarballs.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Default archive directory, in the storage root.
+	defaultArchiveDir = ".archive"
+	// Catalogue of the archived jobs, in the archive directory.
+	catalogueFile = "catalogue.json"
+	// State changes of the job, in its tarball.
+	historyFile = "history.json"
+	// Prefix of the directories of the jobs being restored.
+	restorePrefix = ".restore-"
+)
+
+// archiveDir returns the archive directory of a storage root,
+// '<root>/.archive' unless set.
+func archiveDir(root, dir string) string {
+	if dir == "" {
+		return filepath.Join(root, defaultArchiveDir)
+	}
+	return dir
+}
+
+// Archived describes an archived job in the catalogue.
+type Archived struct {
+	Id     string   `json:"id"`
+	Status string   `json:"status"`
+	Labels []string `json:"labels"`
+	//The moment the job entered its final status
+	Since      time.Time `json:"since"`
+	ArchivedAt time.Time `json:"archived_at"`
+	//The tarball and its size
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// HasLabel indicates if the archived job is labelled with l.
+func (a *Archived) HasLabel(l string) bool {
+	for _, x := range a.Labels {
+		if x == l {
+			return true
+		}
+	}
+	return false
+}
+
+// openArchive loads the catalogue of an archive directory.
+func (idx *Index) openArchive(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	idx.archive = dir
+	idx.archived = make(map[string]*Archived)
+	cnt, err := ioutil.ReadFile(dir + "/" + catalogueFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	entries := make([]*Archived, 0)
+	if err = json.Unmarshal(cnt, &entries); err != nil {
+		return fmt.Errorf("%s: %s", dir+"/"+catalogueFile, err)
+	}
+	for _, e := range entries {
+		//The directory may have moved since
+		e.Path = filepath.Join(dir, e.Id+".tar.gz")
+		idx.archived[e.Id] = e
+	}
+	return nil
+}
+
+// saveCatalogue writes the catalogue. The index must be locked.
+func (idx *Index) saveCatalogue() error {
+	entries := make([]*Archived, 0, len(idx.archived))
+	for _, e := range idx.archived {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].Id < entries[b].Id })
+	cnt, err := json.MarshalIndent(entries, "", " ")
+	if err != nil {
+		return err
+	}
+	tmp := idx.archive + "/." + catalogueFile
+	if err = ioutil.WriteFile(tmp, cnt, 0600); err != nil {
+		return err
+	}
+	if err = syncPath(tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, idx.archive+"/"+catalogueFile)
+}
+
+// GetArchived returns the description of an archived job.
+func (idx *Index) GetArchived(id string) (*Archived, bool) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	a, ok := idx.archived[id]
+	return a, ok
+}
+
+// SelectArchived returns the archived jobs having the given status and
+// label, sorted by identifier. An empty status or label matches every job.
+func (idx *Index) SelectArchived(status, label string) []*Archived {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	res := make([]*Archived, 0)
+	for _, a := range idx.archived {
+		if (status == "" || a.Status == status) && (label == "" || a.HasLabel(label)) {
+			res = append(res, a)
+		}
+	}
+	sort.Slice(res, func(x, y int) bool { return res[x].Id < res[y].Id })
+	return res
+}
+
+// Archive packs a finished job, with its history, into a tarball of the
+// archive directory, then removes it from the index.
+func (idx *Index) Archive(j *Job, by Actor) (*Archived, error) {
+	idx.archiveLock.Lock()
+	defer idx.archiveLock.Unlock()
+	if !j.finished() {
+		return nil, &StatusError{terminated, j.Status()}
+	}
+	//An archive is never replaced
+	if _, ok := idx.GetArchived(j.Id()); ok {
+		return nil, &ConflictError{Job: j.Id(), Archived: true}
+	}
+	history, err := idx.History(j.Id())
+	if err != nil {
+		return nil, err
+	}
+	a := &Archived{
+		Id:         j.Id(),
+		Status:     j.Status().String(),
+		Labels:     j.Labels(),
+		Since:      j.Since(),
+		ArchivedAt: time.Now().UTC(),
+		Path:       filepath.Join(idx.archive, j.Id()+".tar.gz"),
+	}
+	if a.Size, err = writeJobArchive(j, history, a.Path); err != nil {
+		return nil, err
+	}
+	idx.lock.Lock()
+	idx.archived[a.Id] = a
+	if err = idx.saveCatalogue(); err != nil {
+		delete(idx.archived, a.Id)
+		idx.lock.Unlock()
+		os.Remove(a.Path)
+		return nil, err
+	}
+	idx.lock.Unlock()
+	if err = idx.remove(j, by, "archived"); err != nil {
+		idx.lock.Lock()
+		delete(idx.archived, a.Id)
+		idx.saveCatalogue()
+		idx.lock.Unlock()
+		os.Remove(a.Path)
+		return nil, err
+	}
+	metrics.archived()
+	return a, nil
+}
+
+// writeJobArchive writes the files of a job and its history into a
+// compressed tarball. It returns the size of the tarball.
+func writeJobArchive(j *Job, history []AuditEntry, path string) (int64, error) {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	err = filepath.Walk(j.root, func(p string, stat os.FileInfo, err error) error {
+		if err != nil || !stat.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(j.root, p)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(stat, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		//Keep the precise modification times
+		hdr.Format = tar.FormatPAX
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(tw, in)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	cnt, err := json.MarshalIndent(history, "", " ")
+	if err != nil {
+		return 0, err
+	}
+	hdr := &tar.Header{Name: historyFile, Mode: 0600, Size: int64(len(cnt)), ModTime: time.Now()}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return 0, err
+	}
+	if _, err = tw.Write(cnt); err != nil {
+		return 0, err
+	}
+	if err = tw.Close(); err != nil {
+		return 0, err
+	}
+	if err = gz.Close(); err != nil {
+		return 0, err
+	}
+	if err = f.Sync(); err != nil {
+		return 0, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), os.Rename(tmp, path)
+}
+
+// Restore brings an archived job back into the index, with its status.
+func (idx *Index) Restore(id string, by Actor) (*Job, error) {
+	idx.archiveLock.Lock()
+	defer idx.archiveLock.Unlock()
+	a, ok := idx.GetArchived(id)
+	if !ok {
+		return nil, fmt.Errorf("Job '%s' is not archived", id)
+	}
+	if _, ok := idx.GetJob(id); ok {
+		return nil, &ConflictError{Job: id}
+	}
+	tmp := idx.root + "/" + restorePrefix + id
+	os.RemoveAll(tmp)
+	if err := readJobArchive(a.Path, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if _, ok := idx.jobs[id]; ok {
+		os.RemoveAll(tmp)
+		return nil, &ConflictError{Job: id}
+	}
+	root := idx.root + "/" + id
+	if err := os.Rename(tmp, root); err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	j, err := ResumeJob(root, id)
+	if err != nil {
+		//The job stays archived, it must not be resumed on a restart
+		os.RemoveAll(root)
+		return nil, err
+	}
+	idx.attach(j)
+	idx.jobs[id] = j
+	delete(idx.archived, id)
+	if err = idx.saveCatalogue(); err != nil {
+		return j, err
+	}
+	idx.audit.record(by, id, "archived", j.Status().String())
+	metrics.restored()
+	return j, os.Remove(a.Path)
+}
+
+// readJobArchive extracts the files of a job from its tarball. The
+// modification times are kept as the status one tells when the job
+// entered its status.
+func readJobArchive(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || hdr.Name == historyFile {
+			continue
+		}
+		if err = CheckResultName(hdr.Name); err != nil {
+			return fmt.Errorf("%s: illegal path '%s'", path, hdr.Name)
+		}
+		p := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if err = os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return err
+		}
+		if err = os.Chtimes(p, hdr.ModTime, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+	//A job without results has no results directory in its tarball
+	return os.MkdirAll(dir+"/results", 0700)
+}
+
+// ArchiveJob moves a finished job to the archive.
+func ArchiveJob(w http.ResponseWriter, r *http.Request, j *Job) {
+	a, err := idx.Archive(j, actor(r))
+	if err != nil {
+		reportError(w, err, j.Id(), "Unable to archive job '"+j.Id()+"'")
+		return
+	}
+	logger(r).Info("job archived", "job", j.Id(), "archive", a.Path)
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// GetArchivedJobs searches the catalogue by status and label.
+func GetArchivedJobs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(idx.SelectArchived(q.Get("s"), q.Get("l")))
+}
+
+func GetArchivedJob(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["j"]
+	a, ok := idx.GetArchived(id)
+	if !ok {
+		jobNotFound(w, id)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// RestoreJob brings an archived job back into the index.
+func RestoreJob(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["j"]
+	if _, ok := idx.GetArchived(id); !ok {
+		jobNotFound(w, id)
+		return
+	}
+	j, err := idx.Restore(id, actor(r))
+	if err != nil && j == nil {
+		reportError(w, err, id, "Unable to restore job '"+id+"'")
+		return
+	} else if err != nil {
+		//The job is back, only the cleanup of the archive failed
+		logger(r).Error("unable to clean the archive", "job", id, "error", err)
+	}
+	logger(r).Info("job restored", "job", id)
+	GetJob(w, r, j)
+}
@@ -0,0 +1,83 @@
+/**
+ * Archival and restoration of the jobs.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// A restoration that fails to resume the job must leave it archived, and
+// nothing that a restart would resume.
+func TestRestoreFailureKeepsArchived(t *testing.T) {
+	root := t.TempDir()
+	idx, err := NewIndex(root, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := lead(t, idx, fixture{"old", JobSpec{}, terminated, map[string]string{"r": "old"}})
+	//Archived fine, but not resumable
+	if err = ioutil.WriteFile(j.root+"/requirements", []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = idx.Archive(j, System); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = idx.Restore("old", System); err == nil {
+		t.Fatal("restored an unresumable job")
+	}
+	for _, d := range []string{root + "/old", root + "/" + restorePrefix + "old"} {
+		if _, err = os.Stat(d); !os.IsNotExist(err) {
+			t.Errorf("'%s' left behind", d)
+		}
+	}
+	if _, ok := idx.GetArchived("old"); !ok {
+		t.Errorf("old: no longer archived")
+	}
+	restarted, err := NewIndex(root, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restarted.GetJob("old"); ok {
+		t.Errorf("old: resumed as a live job on a restart")
+	}
+	if _, ok := restarted.GetArchived("old"); !ok {
+		t.Errorf("old: no longer archived on a restart")
+	}
+}
+
+// The identifier of an archived job must stay used, so its tarball is
+// never replaced.
+func TestArchivedIdStaysUsed(t *testing.T) {
+	idx, err := NewIndex(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := lead(t, idx, fixture{"old", JobSpec{}, terminated, map[string]string{"r": "old"}})
+	a, err := idx.Archive(j, System)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(a.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.NewJob("old", []byte("new"), JobSpec{}, System)
+	if e, ok := err.(*ConflictError); !ok || !e.Archived {
+		t.Fatalf("got '%v', expected the job to be archived", err)
+	}
+	after, err := ioutil.ReadFile(a.Path)
+	if err != nil || string(after) != string(before) {
+		t.Errorf("the archive was replaced")
+	}
+	if _, err = idx.Restore("old", System); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := idx.GetJob("old"); !ok {
+		t.Errorf("old: not restored")
+	}
+}
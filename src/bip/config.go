@@ -0,0 +1,549 @@
+/**
+ * Configuration of bipd.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config is the configuration of bipd. It is read from a TOML file, then
+// overridden by the environment variables and the command line flags.
+// Durations and sizes are strings like "30s" or "10MB", parsed by Validate.
+type Config struct {
+	Server    ServerConfig    `toml:"server"`
+	Log       LogConfig       `toml:"log"`
+	Limits    LimitsConfig    `toml:"limits"`
+	Retention RetentionConfig `toml:"retention"`
+	Workers   WorkersConfig   `toml:"workers"`
+	FairShare FairShareConfig `toml:"fair_share"`
+	Quotas    QuotasConfig    `toml:"quotas"`
+	Throttle  ThrottleConfig  `toml:"throttle"`
+	//The bearer tokens, indexed by identity
+	Tokens map[string]string `toml:"tokens"`
+}
+
+// ServerConfig describes where bipd listens and stores the jobs.
+type ServerConfig struct {
+	Listen       []string `toml:"listen"`
+	AdminListen  []string `toml:"admin_listen"`
+	SocketMode   string   `toml:"socket_mode"`
+	Root         string   `toml:"root"`
+	ArchiveDir   string   `toml:"archive_dir"`
+	DrainTimeout string   `toml:"drain_timeout"`
+	MinFreeSpace string   `toml:"min_free_space"`
+
+	endpoints    []Endpoint
+	drainTimeout time.Duration
+	minFreeSpace uint64
+}
+
+// LogConfig describes where bipd logs.
+type LogConfig struct {
+	//Empty for the standard error
+	File  string `toml:"file"`
+	Level string `toml:"level"`
+}
+
+// LimitsConfig bounds the size of the requests. The data and the results
+// are held in memory while they are received.
+type LimitsConfig struct {
+	MaxDataSize   string `toml:"max_data_size"`
+	MaxResultSize string `toml:"max_result_size"`
+
+	maxDataSize   int64
+	maxResultSize int64
+}
+
+// RetentionConfig decides when the finished jobs are deleted. Jobs having
+// the pin label are never deleted.
+type RetentionConfig struct {
+	//Age of the terminated jobs to delete. 0 keeps them
+	MaxAge string `toml:"max_age"`
+	//Age of the failed and expired jobs to delete. 0 keeps them
+	FailedMaxAge string `toml:"failed_max_age"`
+	//Number of terminated jobs to keep per label. 0 means no limit
+	MaxPerLabel int    `toml:"max_per_label"`
+	PinLabel    string `toml:"pin_label"`
+	//Delay between two collections. 0 disables the collector
+	Interval string `toml:"interval"`
+	//Archive the jobs rather than deleting them
+	Archive bool `toml:"archive"`
+	//Only log what the collector would delete
+	DryRun bool `toml:"dry_run"`
+
+	maxAge       time.Duration
+	failedMaxAge time.Duration
+	interval     time.Duration
+}
+
+// WorkersConfig describes the liveness of the workers.
+type WorkersConfig struct {
+	//Delay without heartbeat before a worker is stale. 0 never flags them
+	StaleAfter string `toml:"stale_after"`
+
+	staleAfter time.Duration
+}
+
+// FairShareConfig shares the processing among the submitters of the
+// jobs, or among their first label.
+type FairShareConfig struct {
+	//'submitter' or 'label'. Empty hands out the ready jobs in no particular order
+	By string `toml:"by"`
+	//The number of jobs a share gets in a row. Default is 1
+	Weights map[string]int `toml:"weights"`
+	//The maximum number of jobs processed at once per share. 0 means no limit
+	MaxRunning int `toml:"max_running"`
+	//The maximum number of jobs processed at once, for some shares
+	Caps map[string]int `toml:"caps"`
+}
+
+// Quota bounds the jobs of a submitter, or of a queue. 0 means no limit.
+type Quota struct {
+	//The number of jobs stored, whatever their status
+	MaxJobs int `toml:"max_jobs"`
+	//The size of the data and the results stored
+	MaxBytes string `toml:"max_bytes"`
+	//The number of submissions per minute
+	MaxRate int `toml:"max_rate"`
+
+	maxBytes int64
+}
+
+// QuotasConfig bounds the jobs per submitter, and per queue. A queue
+// gathers the jobs having a label.
+type QuotasConfig struct {
+	//The quota of the submitters not listed
+	Default    Quota            `toml:"default"`
+	Submitters map[string]Quota `toml:"submitters"`
+	Queues     map[string]Quota `toml:"queues"`
+}
+
+// ThrottleConfig protects bipd from the clients sending too many requests,
+// or sending them too slowly. 0 means no limit.
+type ThrottleConfig struct {
+	//Requests per second per client address, and the burst allowed
+	IPRate  float64 `toml:"ip_rate"`
+	IPBurst int     `toml:"ip_burst"`
+	//Requests per second per token, and the burst allowed
+	TokenRate  float64 `toml:"token_rate"`
+	TokenBurst int     `toml:"token_burst"`
+	//Open connections, in total and per client address
+	MaxConnections      int `toml:"max_connections"`
+	MaxConnectionsPerIP int `toml:"max_connections_per_ip"`
+	//Delays to read the request headers, and between two reads of a request body
+	ReadHeaderTimeout string `toml:"read_header_timeout"`
+	BodyTimeout       string `toml:"body_timeout"`
+	//Delay before closing an idle connection
+	IdleTimeout    string `toml:"idle_timeout"`
+	MaxHeaderBytes string `toml:"max_header_bytes"`
+
+	readHeaderTimeout time.Duration
+	bodyTimeout       time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int64
+}
+
+// DefaultConfig returns the configuration used when no file is provided.
+func DefaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Listen:       []string{":6798"},
+			SocketMode:   "0660",
+			Root:         "./bip_data",
+			DrainTimeout: "30s",
+			MinFreeSpace: "100MB",
+		},
+		Log: LogConfig{Level: "info"},
+		Limits: LimitsConfig{
+			MaxDataSize:   "64MB",
+			MaxResultSize: "64MB",
+		},
+		Retention: RetentionConfig{
+			MaxAge:       "0",
+			FailedMaxAge: "0",
+			PinLabel:     "pinned",
+			Interval:     "1h",
+		},
+		Workers: WorkersConfig{StaleAfter: "1m"},
+		Quotas:  QuotasConfig{Default: Quota{MaxBytes: "0"}},
+		Throttle: ThrottleConfig{
+			ReadHeaderTimeout: "10s",
+			BodyTimeout:       "1m",
+			IdleTimeout:       "2m",
+			MaxHeaderBytes:    "64KB",
+		},
+	}
+}
+
+// LoadConfig reads a configuration file over the default configuration.
+// Unknown keys are rejected.
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+	md, err := toml.DecodeFile(path, c)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if keys := md.Undecoded(); len(keys) > 0 {
+		return nil, fmt.Errorf("%s: unknown key '%s'", path, keys[0])
+	}
+	return c, nil
+}
+
+// ConfigError reports an invalid value.
+type ConfigError struct {
+	Key     string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid value for '%s': %s", e.Key, e.Message)
+}
+
+// Env overrides the configuration with the environment variables named
+// BIPD_<SECTION>_<KEY>, like BIPD_SERVER_ROOT. Lists are comma-separated.
+func (c *Config) Env() error {
+	return overrideFromEnv(reflect.ValueOf(c).Elem(), "BIPD")
+}
+
+func overrideFromEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := f.Tag.Get("toml")
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(key)
+		switch f.Type.Kind() {
+		case reflect.Struct:
+			if err := overrideFromEnv(v.Field(i), name); err != nil {
+				return err
+			}
+		case reflect.String:
+			if x, ok := os.LookupEnv(name); ok {
+				v.Field(i).SetString(x)
+			}
+		case reflect.Slice:
+			if x, ok := os.LookupEnv(name); ok {
+				v.Field(i).Set(reflect.ValueOf(strings.Split(x, ",")))
+			}
+		case reflect.Int:
+			if x, ok := os.LookupEnv(name); ok {
+				n, err := strconv.Atoi(x)
+				if err != nil {
+					return fmt.Errorf("%s: expected an integer, got '%s'", name, x)
+				}
+				v.Field(i).SetInt(int64(n))
+			}
+		case reflect.Float64:
+			if x, ok := os.LookupEnv(name); ok {
+				f, err := strconv.ParseFloat(x, 64)
+				if err != nil {
+					return fmt.Errorf("%s: expected a number, got '%s'", name, x)
+				}
+				v.Field(i).SetFloat(f)
+			}
+		case reflect.Bool:
+			if x, ok := os.LookupEnv(name); ok {
+				b, err := strconv.ParseBool(x)
+				if err != nil {
+					return fmt.Errorf("%s: expected a boolean, got '%s'", name, x)
+				}
+				v.Field(i).SetBool(b)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks the configuration and parses the durations and the sizes.
+func (c *Config) Validate() error {
+	var err error
+	mode, err := strconv.ParseUint(c.Server.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return &ConfigError{"server.socket_mode", "expected octal permissions like '0660', got '" + c.Server.SocketMode + "'"}
+	}
+	c.Server.endpoints = make([]Endpoint, 0)
+	if len(c.Server.Listen)+len(c.Server.AdminListen) == 0 {
+		return &ConfigError{"server.listen", "at least one endpoint is required"}
+	}
+	for i, a := range append(c.Server.Listen, c.Server.AdminListen...) {
+		key := fmt.Sprintf("server.listen[%d]", i)
+		if i >= len(c.Server.Listen) {
+			key = fmt.Sprintf("server.admin_listen[%d]", i-len(c.Server.Listen))
+		}
+		e, err := ParseEndpoint(a)
+		if err != nil {
+			return &ConfigError{key, err.Error()}
+		}
+		e.Mode = os.FileMode(mode)
+		//Without dedicated endpoints, the administration routes are served everywhere
+		e.Admin = i >= len(c.Server.Listen) || len(c.Server.AdminListen) == 0
+		c.Server.endpoints = append(c.Server.endpoints, e)
+	}
+	var l slog.Level
+	if err = l.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		return &ConfigError{"log.level", "expected 'debug', 'info', 'warn' or 'error', got '" + c.Log.Level + "'"}
+	}
+	seen := make(map[string]string)
+	for name, tok := range c.Tokens {
+		if tok == "" {
+			return &ConfigError{"tokens." + name, "empty token"}
+		}
+		if x, ok := seen[tok]; ok {
+			return &ConfigError{"tokens." + name, "same token as 'tokens." + x + "'"}
+		}
+		if name == anonymous || name == unknownToken || name == SystemActor {
+			return &ConfigError{"tokens." + name, "reserved identity"}
+		}
+		seen[tok] = name
+	}
+	if c.Server.Root == "" {
+		return &ConfigError{"server.root", "empty path"}
+	}
+	if c.Server.drainTimeout, err = parseDuration("server.drain_timeout", c.Server.DrainTimeout); err != nil {
+		return err
+	}
+	var size int64
+	if size, err = parseSize("server.min_free_space", c.Server.MinFreeSpace); err != nil {
+		return err
+	}
+	c.Server.minFreeSpace = uint64(size)
+	if c.Limits.maxDataSize, err = parseSize("limits.max_data_size", c.Limits.MaxDataSize); err != nil {
+		return err
+	}
+	if c.Limits.maxResultSize, err = parseSize("limits.max_result_size", c.Limits.MaxResultSize); err != nil {
+		return err
+	}
+	if c.Retention.maxAge, err = parseDuration("retention.max_age", c.Retention.MaxAge); err != nil {
+		return err
+	}
+	if c.Retention.failedMaxAge, err = parseDuration("retention.failed_max_age", c.Retention.FailedMaxAge); err != nil {
+		return err
+	}
+	if c.Retention.interval, err = parseDuration("retention.interval", c.Retention.Interval); err != nil {
+		return err
+	}
+	if c.Workers.staleAfter, err = parseDuration("workers.stale_after", c.Workers.StaleAfter); err != nil {
+		return err
+	}
+	if c.Retention.MaxPerLabel < 0 {
+		return &ConfigError{"retention.max_per_label", "negative number"}
+	}
+	if c.FairShare.By != "" && c.FairShare.By != "submitter" && c.FairShare.By != "label" {
+		return &ConfigError{"fair_share.by", "expected 'submitter', 'label' or '', got '" + c.FairShare.By + "'"}
+	}
+	for k, w := range c.FairShare.Weights {
+		if w < 1 {
+			return &ConfigError{"fair_share.weights." + k, "expected a positive integer"}
+		}
+	}
+	if c.FairShare.MaxRunning < 0 {
+		return &ConfigError{"fair_share.max_running", "negative number"}
+	}
+	for k, n := range c.FairShare.Caps {
+		if n < 0 {
+			return &ConfigError{"fair_share.caps." + k, "negative number"}
+		}
+	}
+	if err = c.Throttle.validate(); err != nil {
+		return err
+	}
+	if err = c.Quotas.Default.validate("quotas.default"); err != nil {
+		return err
+	}
+	for _, m := range []struct {
+		key    string
+		quotas map[string]Quota
+	}{{"quotas.submitters.", c.Quotas.Submitters}, {"quotas.queues.", c.Quotas.Queues}} {
+		for k, q := range m.quotas {
+			if err = q.validate(m.key + k); err != nil {
+				return err
+			}
+			m.quotas[k] = q
+		}
+	}
+	return nil
+}
+
+func (t *ThrottleConfig) validate() error {
+	var err error
+	if t.IPRate < 0 || t.IPBurst < 0 {
+		return &ConfigError{"throttle.ip_rate", "negative number"}
+	}
+	if t.TokenRate < 0 || t.TokenBurst < 0 {
+		return &ConfigError{"throttle.token_rate", "negative number"}
+	}
+	if t.MaxConnections < 0 || t.MaxConnectionsPerIP < 0 {
+		return &ConfigError{"throttle.max_connections", "negative number"}
+	}
+	if t.readHeaderTimeout, err = parseDuration("throttle.read_header_timeout", t.ReadHeaderTimeout); err != nil {
+		return err
+	}
+	if t.bodyTimeout, err = parseDuration("throttle.body_timeout", t.BodyTimeout); err != nil {
+		return err
+	}
+	if t.idleTimeout, err = parseDuration("throttle.idle_timeout", t.IdleTimeout); err != nil {
+		return err
+	}
+	if t.maxHeaderBytes, err = parseSize("throttle.max_header_bytes", t.MaxHeaderBytes); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (q *Quota) validate(key string) error {
+	var err error
+	if q.MaxBytes == "" {
+		q.MaxBytes = "0"
+	}
+	if q.maxBytes, err = parseSize(key+".max_bytes", q.MaxBytes); err != nil {
+		return err
+	}
+	if q.MaxJobs < 0 {
+		return &ConfigError{key + ".max_jobs", "negative number"}
+	}
+	if q.MaxRate < 0 {
+		return &ConfigError{key + ".max_rate", "negative number"}
+	}
+	return nil
+}
+
+// Endpoints are the addresses to listen on.
+func (c *Config) Endpoints() []Endpoint {
+	return c.Server.endpoints
+}
+
+// DrainTimeout is the maximum duration to wait for the in-flight requests on shutdown.
+func (c *Config) DrainTimeout() time.Duration {
+	return c.Server.drainTimeout
+}
+
+// MinFreeSpace is the free space in bytes required on the storage to be ready.
+func (c *Config) MinFreeSpace() uint64 {
+	return c.Server.minFreeSpace
+}
+
+func parseDuration(key, s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, &ConfigError{key, "expected a duration like '30s' or '5m', got '" + s + "'"}
+	}
+	if d < 0 {
+		return 0, &ConfigError{key, "negative duration"}
+	}
+	return d, nil
+}
+
+var sizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"TB", 1 << 40}, {"B", 1},
+}
+
+// parseSize parses a size in bytes, with an optional unit among B, KB, MB, GB and TB.
+// 0 means no limit.
+func parseSize(key, s string) (int64, error) {
+	x := strings.ToUpper(strings.TrimSpace(s))
+	factor := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(x, u.suffix) {
+			x = strings.TrimSpace(strings.TrimSuffix(x, u.suffix))
+			factor = u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(x, 10, 64)
+	if err != nil || n < 0 {
+		return 0, &ConfigError{key, "expected a size like '512KB' or '10GB', got '" + s + "'"}
+	}
+	return n * factor, nil
+}
+
+var (
+	limits     LimitsConfig
+	retention  RetentionConfig
+	workers    WorkersConfig
+	fairShare  FairShareConfig
+	quotas     QuotasConfig
+	throttling ThrottleConfig
+	limitsLock sync.RWMutex
+)
+
+// ApplyConfig applies the settings that can change while bipd is
+// running. The configuration must be validated.
+func ApplyConfig(c *Config) {
+	limitsLock.Lock()
+	defer limitsLock.Unlock()
+	limits = c.Limits
+	retention = c.Retention
+	workers = c.Workers
+	fairShare = c.FairShare
+	quotas = c.Quotas
+	throttling = c.Throttle
+	minFreeSpace = c.MinFreeSpace()
+	setTokens(c.Tokens)
+}
+
+func currentMinFreeSpace() uint64 {
+	limitsLock.RLock()
+	defer limitsLock.RUnlock()
+	return minFreeSpace
+}
+
+func currentRetention() RetentionConfig {
+	limitsLock.RLock()
+	defer limitsLock.RUnlock()
+	return retention
+}
+
+func currentWorkers() WorkersConfig {
+	limitsLock.RLock()
+	defer limitsLock.RUnlock()
+	return workers
+}
+
+func currentFairShare() FairShareConfig {
+	limitsLock.RLock()
+	defer limitsLock.RUnlock()
+	return fairShare
+}
+
+func currentQuotas() QuotasConfig {
+	limitsLock.RLock()
+	defer limitsLock.RUnlock()
+	return quotas
+}
+
+func currentThrottle() ThrottleConfig {
+	limitsLock.RLock()
+	defer limitsLock.RUnlock()
+	return throttling
+}
+
+func currentLimits() LimitsConfig {
+	limitsLock.RLock()
+	defer limitsLock.RUnlock()
+	return limits
+}
+
+// limitBody bounds the size of the request body. 0 means no limit.
+func limitBody(w http.ResponseWriter, r *http.Request, max int64) {
+	if max > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+	}
+}
@@ -0,0 +1,421 @@
+/**
+ * Recurring jobs, spawned on a cron schedule.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// The recurring jobs, in the storage root.
+	cronFile = ".cron.json"
+	// Identifier of the spawned jobs when no pattern is given.
+	defaultIdPattern = `{{.Name}}-{{.Time.Format "20060102-1504"}}`
+	// A run due for longer is a missed one, subject to the catch-up rule.
+	cronGrace = time.Minute
+	// Maximum number of missed runs caught up at once.
+	maxCatchUp = 100
+)
+
+// Overlap policies, when the job of the previous run is not finished.
+const (
+	OverlapSkip   = "skip"
+	OverlapAllow  = "allow"
+	OverlapCancel = "cancel"
+)
+
+// Catch-up rules, for the runs missed while bipd was down.
+const (
+	CatchUpNone = "none"
+	CatchUpLast = "last"
+	CatchUpAll  = "all"
+)
+
+var cronName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Cron is a recurring job. Every run spawns a job from the templates.
+type Cron struct {
+	Name      string    `json:"name"`
+	Schedule  string    `json:"schedule"`
+	IdPattern string    `json:"id_pattern"`
+	Data      string    `json:"data"`
+	Labels    []string  `json:"labels"`
+	Overlap   string    `json:"overlap"`
+	CatchUp   string    `json:"catch_up"`
+	Created   time.Time `json:"created"`
+	//The last run, the number of jobs spawned and the last one
+	Last    time.Time `json:"last"`
+	Runs    int       `json:"runs"`
+	LastJob string    `json:"last_job,omitempty"`
+	//The next run. Only set when the recurring job is described
+	Next *time.Time `json:"next,omitempty"`
+
+	schedule *CronSchedule
+	id, data *template.Template
+}
+
+// CronRun is the value the templates of a recurring job are executed on.
+type CronRun struct {
+	Name string
+	//The moment the run was due, and its number, starting at 1
+	Time time.Time
+	Seq  int
+}
+
+// compile parses the schedule and the templates, and checks the policies.
+func (c *Cron) compile() error {
+	var err error
+	if !cronName.MatchString(c.Name) {
+		return fmt.Errorf("Invalid recurring job name '%s'", c.Name)
+	}
+	if c.schedule, err = ParseCron(c.Schedule); err != nil {
+		return err
+	}
+	if c.IdPattern == "" {
+		c.IdPattern = defaultIdPattern
+	}
+	if c.id, err = template.New("id").Option("missingkey=error").Parse(c.IdPattern); err != nil {
+		return fmt.Errorf("Invalid identifier pattern: %s", err)
+	}
+	if c.data, err = template.New("data").Option("missingkey=error").Parse(c.Data); err != nil {
+		return fmt.Errorf("Invalid data template: %s", err)
+	}
+	if c.Overlap == "" {
+		c.Overlap = OverlapSkip
+	} else if c.Overlap != OverlapSkip && c.Overlap != OverlapAllow && c.Overlap != OverlapCancel {
+		return fmt.Errorf("Unsupported overlap policy '%s'", c.Overlap)
+	}
+	if c.CatchUp == "" {
+		c.CatchUp = CatchUpNone
+	} else if c.CatchUp != CatchUpNone && c.CatchUp != CatchUpLast && c.CatchUp != CatchUpAll {
+		return fmt.Errorf("Unsupported catch-up rule '%s'", c.CatchUp)
+	}
+	//The templates must give a usable job
+	if _, _, err = c.render(CronRun{c.Name, time.Now(), c.Runs + 1}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// render returns the identifier and the data of the job of a run.
+func (c *Cron) render(run CronRun) (string, []byte, error) {
+	var id, data bytes.Buffer
+	if err := c.id.Execute(&id, run); err != nil {
+		return "", nil, fmt.Errorf("Invalid identifier pattern: %s", err)
+	}
+	if err := c.data.Execute(&data, run); err != nil {
+		return "", nil, fmt.Errorf("Invalid data template: %s", err)
+	}
+	s := id.String()
+	if CheckJobId(s) != nil {
+		return "", nil, fmt.Errorf("Invalid job identifier '%s' from pattern '%s'", s, c.IdPattern)
+	}
+	return s, data.Bytes(), nil
+}
+
+// due returns the runs of the schedule after the last one, up to now,
+// and their number. Only the last maxCatchUp runs are kept.
+func (c *Cron) due(now time.Time) ([]time.Time, int) {
+	res := make([]time.Time, 0)
+	n := 0
+	for t := c.schedule.Next(c.Last); !t.IsZero() && !t.After(now); t = c.schedule.Next(t) {
+		if len(res) == maxCatchUp {
+			res = append(res[:0], res[1:]...)
+		}
+		res = append(res, t)
+		n++
+	}
+	return res, n
+}
+
+// loadCrons reads the recurring jobs of the storage root.
+func (idx *Index) loadCrons() error {
+	idx.crons = make(map[string]*Cron)
+	cnt, err := ioutil.ReadFile(idx.root + "/" + cronFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	crons := make([]*Cron, 0)
+	if err = json.Unmarshal(cnt, &crons); err != nil {
+		return fmt.Errorf("%s: %s", idx.root+"/"+cronFile, err)
+	}
+	for _, c := range crons {
+		if err = c.compile(); err != nil {
+			return fmt.Errorf("%s: %s", idx.root+"/"+cronFile, err)
+		}
+		//The moments are read with the offset they were written with, that
+		//does not follow the daylight saving time changes of the schedule
+		c.Created = c.Created.In(c.schedule.Location())
+		c.Last = c.Last.In(c.schedule.Location())
+		idx.crons[c.Name] = c
+	}
+	return nil
+}
+
+// marshalCrons returns the recurring jobs, as stored. The crons must be locked.
+func (idx *Index) marshalCrons() ([]byte, error) {
+	crons := make([]*Cron, 0, len(idx.crons))
+	for _, c := range idx.crons {
+		crons = append(crons, c)
+	}
+	sort.Slice(crons, func(a, b int) bool { return crons[a].Name < crons[b].Name })
+	return json.MarshalIndent(crons, "", " ")
+}
+
+// saveCrons writes the recurring jobs. The crons must be locked.
+func (idx *Index) saveCrons() error {
+	cnt, err := idx.marshalCrons()
+	if err != nil {
+		return err
+	}
+	tmp := idx.root + "/" + cronFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, cnt, 0600); err != nil {
+		return err
+	}
+	if err = syncPath(tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, idx.root+"/"+cronFile)
+}
+
+// describe returns a copy of a recurring job with its next run.
+func (c *Cron) describe(now time.Time) Cron {
+	d := *c
+	from := c.Last
+	if from.Before(now) && c.CatchUp == CatchUpNone {
+		from = now
+	}
+	if next := c.schedule.Next(from); !next.IsZero() {
+		d.Next = &next
+	}
+	return d
+}
+
+// Crons returns the recurring jobs, sorted by name.
+func (idx *Index) Crons() []Cron {
+	idx.cronLock.Lock()
+	defer idx.cronLock.Unlock()
+	now := time.Now()
+	res := make([]Cron, 0, len(idx.crons))
+	for _, c := range idx.crons {
+		res = append(res, c.describe(now))
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].Name < res[b].Name })
+	return res
+}
+
+// GetCron returns a recurring job.
+func (idx *Index) GetCron(name string) (Cron, bool) {
+	idx.cronLock.Lock()
+	defer idx.cronLock.Unlock()
+	c, ok := idx.crons[name]
+	if !ok {
+		return Cron{}, false
+	}
+	return c.describe(time.Now()), true
+}
+
+// AddCron registers a recurring job. Its first run is the first one of
+// the schedule after now.
+func (idx *Index) AddCron(c *Cron) error {
+	if err := c.compile(); err != nil {
+		return err
+	}
+	idx.cronLock.Lock()
+	defer idx.cronLock.Unlock()
+	if _, ok := idx.crons[c.Name]; ok {
+		return &CronConflictError{c.Name}
+	}
+	c.Created = time.Now()
+	c.Last = c.Created
+	idx.crons[c.Name] = c
+	if err := idx.saveCrons(); err != nil {
+		delete(idx.crons, c.Name)
+		return err
+	}
+	return nil
+}
+
+// DeleteCron removes a recurring job. The jobs it spawned are kept.
+func (idx *Index) DeleteCron(name string) (bool, error) {
+	idx.cronLock.Lock()
+	defer idx.cronLock.Unlock()
+	c, ok := idx.crons[name]
+	if !ok {
+		return false, nil
+	}
+	delete(idx.crons, name)
+	if err := idx.saveCrons(); err != nil {
+		idx.crons[name] = c
+		return true, err
+	}
+	return true, nil
+}
+
+// CronConflictError signals a recurring job with the same name exists.
+type CronConflictError struct {
+	Name string
+}
+
+func (err *CronConflictError) Error() string {
+	return "Recurring job '" + err.Name + "' already exists"
+}
+
+// runCrons spawns the jobs of the due runs.
+func (idx *Index) runCrons(now time.Time) {
+	idx.cronLock.Lock()
+	defer idx.cronLock.Unlock()
+	changed := false
+	for _, c := range idx.crons {
+		due, n := c.due(now)
+		if n == 0 {
+			continue
+		}
+		last := due[len(due)-1]
+		switch c.CatchUp {
+		case CatchUpNone:
+			if now.Sub(last) > cronGrace {
+				due = nil
+			} else {
+				due = due[len(due)-1:]
+			}
+		case CatchUpLast:
+			due = due[len(due)-1:]
+		}
+		if skipped := n - len(due); skipped > 0 {
+			slog.Warn("missed runs not caught up", "cron", c.Name, "runs", skipped)
+		}
+		for _, t := range due {
+			idx.spawn(c, t)
+		}
+		c.Last = last
+		changed = true
+	}
+	if changed {
+		if err := idx.saveCrons(); err != nil {
+			slog.Error("unable to save the recurring jobs", "error", err)
+		}
+	}
+}
+
+// spawn creates the job of a run, according to the overlap policy.
+func (idx *Index) spawn(c *Cron, at time.Time) {
+	by := Actor{Who: SystemActor, RequestId: "cron:" + c.Name}
+	if prev, ok := idx.GetJob(c.LastJob); ok && !prev.finished() {
+		switch c.Overlap {
+		case OverlapSkip:
+			slog.Info("run skipped, previous job not finished", "cron", c.Name, "job", prev.Id(), "status", prev.Status().String())
+			return
+		case OverlapCancel:
+			if err := prev.Cancel(by); err != nil {
+				slog.Error("unable to cancel the previous job", "cron", c.Name, "job", prev.Id(), "error", err)
+			}
+		}
+	}
+	run := CronRun{c.Name, at, c.Runs + 1}
+	id, data, err := c.render(run)
+	if err == nil {
+		err = idx.NewJob(id, data, JobSpec{Labels: c.Labels, Submitter: "cron:" + c.Name}, by)
+	}
+	if err != nil {
+		slog.Error("unable to spawn the job of a run", "cron", c.Name, "run", at, "error", err)
+		return
+	}
+	c.Runs = run.Seq
+	c.LastJob = id
+	slog.Info("job spawned", "cron", c.Name, "job", id)
+}
+
+func cronNotFound(w http.ResponseWriter, name string) {
+	writeError(w, http.StatusNotFound, &APIError{Code: CodeCronNotFound, Message: "Recurring job '" + name + "' not found"})
+}
+
+// GetCrons lists the recurring jobs.
+func GetCrons(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(idx.Crons())
+}
+
+func GetCron(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["c"]
+	c, ok := idx.GetCron(name)
+	if !ok {
+		cronNotFound(w, name)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// PostCron registers a recurring job. The body is the data template.
+func PostCron(w http.ResponseWriter, r *http.Request) {
+	limitBody(w, r, currentLimits().maxDataSize)
+	r.ParseForm()
+	c := &Cron{
+		Name:      r.Form.Get("name"),
+		Schedule:  r.Form.Get("schedule"),
+		IdPattern: r.Form.Get("id"),
+		Overlap:   r.Form.Get("overlap"),
+		CatchUp:   r.Form.Get("catch_up"),
+		Labels:    make([]string, 0),
+	}
+	if c.Name == "" || c.Schedule == "" {
+		badRequest(w, CodeMissingParameter, "Missing required parameters 'name' and 'schedule'")
+		return
+	}
+	for _, l := range r.Form["l"] {
+		for _, x := range strings.Split(l, ",") {
+			if x = strings.TrimSpace(x); x != "" {
+				c.Labels = append(c.Labels, x)
+			}
+		}
+	}
+	cnt, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	c.Data = string(cnt)
+	if err := idx.AddCron(c); err != nil {
+		if e, ok := err.(*CronConflictError); ok {
+			writeError(w, http.StatusConflict, &APIError{Code: CodeCronExists, Message: e.Error()})
+		} else if _, ok := err.(*os.PathError); ok {
+			reportError(w, err, "", "Unable to save recurring job '"+c.Name+"'")
+		} else {
+			badRequest(w, CodeInvalidParameter, err.Error())
+		}
+		return
+	}
+	http.Redirect(w, r, baseURL(r)+"/cron/"+c.Name, http.StatusCreated)
+	logger(r).Info("recurring job added", "cron", c.Name, "schedule", c.Schedule)
+}
+
+func DeleteCron(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["c"]
+	ok, err := idx.DeleteCron(name)
+	if !ok {
+		cronNotFound(w, name)
+		return
+	} else if err != nil {
+		reportError(w, err, "", "Unable to delete recurring job '"+name+"'")
+		return
+	}
+	logger(r).Info("recurring job deleted", "cron", name)
+}
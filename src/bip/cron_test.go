@@ -0,0 +1,54 @@
+/**
+ * Recurring jobs.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"testing"
+	"time"
+)
+
+// Once reloaded, the runs of a recurring job must follow the daylight
+// saving time changes of its location.
+func TestCronReloadKeepsLocation(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer func(l *time.Location) { time.Local = l }(time.Local)
+	time.Local = paris
+
+	root := t.TempDir()
+	idx, err := NewIndex(root, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = idx.AddCron(&Cron{Name: "noon", Schedule: "0 12 * * *"}); err != nil {
+		t.Fatal(err)
+	}
+	//The day before leaving the summer time
+	last := time.Date(2024, 10, 26, 12, 0, 0, 0, paris)
+	idx.cronLock.Lock()
+	//As written by a bipd running in another location
+	idx.crons["noon"].Last = last.UTC()
+	err = idx.saveCrons()
+	idx.cronLock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewIndex(root, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := restarted.crons["noon"]
+	if !c.Last.Equal(last) {
+		t.Fatalf("last run %s, expected %s", c.Last, last)
+	}
+	expected := time.Date(2024, 10, 27, 12, 0, 0, 0, paris)
+	if next := c.schedule.Next(c.Last); !next.Equal(expected) {
+		t.Errorf("next run %s, expected %s", next, expected)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+/**
+ * Free space on the systems bipd cannot inspect.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import "math"
+
+// freeSpace is not supported, the space is considered as unlimited.
+func freeSpace(path string) (uint64, error) {
+	return math.MaxUint64, nil
+}
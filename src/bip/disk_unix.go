@@ -0,0 +1,20 @@
+//go:build unix
+
+/**
+ * Free space on unix systems.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import "syscall"
+
+// freeSpace returns the space available to bipd on the filesystem
+// holding path, in bytes.
+func freeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
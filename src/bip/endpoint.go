@@ -0,0 +1,70 @@
+/**
+ * Endpoints bipd listens on.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Endpoint is an address bipd listens on: a TCP 'host:port' or a Unix
+// domain socket.
+type Endpoint struct {
+	Network string
+	Address string
+	//The permissions of a Unix domain socket
+	Mode os.FileMode
+	//Serve the administration routes
+	Admin bool
+}
+
+// ParseEndpoint parses an address like 'host:port', ':port',
+// 'tcp://host:port' or 'unix:///path/to/socket'.
+func ParseEndpoint(s string) (Endpoint, error) {
+	if strings.HasPrefix(s, "unix://") {
+		p := strings.TrimPrefix(s, "unix://")
+		if p == "" {
+			return Endpoint{}, fmt.Errorf("missing socket path in '%s'", s)
+		}
+		return Endpoint{Network: "unix", Address: p}, nil
+	}
+	addr := strings.TrimPrefix(s, "tcp://")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return Endpoint{}, fmt.Errorf("expected 'host:port', ':port', 'tcp://host:port' or 'unix:///path', got '%s'", s)
+	}
+	return Endpoint{Network: "tcp", Address: addr}, nil
+}
+
+func (e Endpoint) String() string {
+	return e.Network + "://" + e.Address
+}
+
+// Listen opens the endpoint. A stale Unix domain socket is replaced.
+func (e Endpoint) Listen() (net.Listener, error) {
+	if e.Network != "unix" {
+		return net.Listen(e.Network, e.Address)
+	}
+	if stat, err := os.Stat(e.Address); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", e.Address); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("socket '%s' is already in use", e.Address)
+		}
+		os.Remove(e.Address)
+	}
+	l, err := net.Listen("unix", e.Address)
+	if err != nil {
+		return nil, err
+	}
+	if e.Mode != 0 {
+		if err = os.Chmod(e.Address, e.Mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
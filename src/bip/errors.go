@@ -0,0 +1,160 @@
+/**
+ * Errors reported by the REST API.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Machine-readable error codes. They are part of the API and must not change.
+const (
+	CodeMissingParameter = "missing_parameter"
+	CodeInvalidParameter = "invalid_parameter"
+	CodeJobNotFound      = "job_not_found"
+	CodeNoMatchingJob    = "no_matching_job"
+	CodeResultNotFound   = "result_not_found"
+	CodeJobExists        = "job_exists"
+	CodeResultExists     = "result_exists"
+	CodeBadStatus        = "bad_status"
+	CodeStorage          = "storage_error"
+	CodeInternal         = "internal_error"
+	CodeUnavailable      = "unavailable"
+	CodeTooLarge         = "too_large"
+	CodeAdminOnly        = "admin_only"
+	CodeJobArchived      = "job_archived"
+	CodeCronNotFound     = "cron_not_found"
+	CodeCronExists       = "cron_exists"
+	CodeWorkerNotFound   = "worker_not_found"
+	CodeWorkerBusy       = "worker_busy"
+	CodeQuotaExceeded    = "quota_exceeded"
+	CodeRateLimited      = "rate_limited"
+	CodeRequestTimeout   = "request_timeout"
+	CodeAttemptOver      = "attempt_over"
+)
+
+// APIError is the JSON body of every error response.
+type APIError struct {
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	Job      string `json:"job,omitempty"`
+	Result   string `json:"result,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	//The tarball of an archived job
+	Archive string `json:"archive,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func writeError(w http.ResponseWriter, status int, e *APIError) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// retryAfter returns the number of seconds to announce in 'Retry-After'
+// for a wait: rounded up, and at least one so the clients do wait.
+func retryAfter(wait time.Duration) int {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
+}
+
+func badRequest(w http.ResponseWriter, code, msg string) {
+	writeError(w, http.StatusBadRequest, &APIError{Code: code, Message: msg})
+}
+
+// readBody reads the request body. It reports the error and returns
+// false if the body cannot be read or exceeds its limit.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	cnt, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		return cnt, true
+	}
+	if e, ok := err.(*http.MaxBytesError); ok {
+		writeError(w, http.StatusRequestEntityTooLarge, &APIError{Code: CodeTooLarge,
+			Message: fmt.Sprintf("The body exceeds the limit of %d bytes", e.Limit)})
+	} else if err == errBodyTimeout {
+		writeError(w, http.StatusRequestTimeout, &APIError{Code: CodeRequestTimeout,
+			Message: "Unable to read the body: " + err.Error()})
+	} else {
+		badRequest(w, CodeInvalidParameter, "Unable to read the body: "+err.Error())
+	}
+	return nil, false
+}
+
+func jobNotFound(w http.ResponseWriter, id string) {
+	writeError(w, http.StatusNotFound, &APIError{Code: CodeJobNotFound, Message: "Job '" + id + "' not found", Job: id})
+}
+
+// jobArchived tells where an archived job went.
+func jobArchived(w http.ResponseWriter, a *Archived) {
+	writeError(w, http.StatusGone, &APIError{Code: CodeJobArchived, Job: a.Id, Archive: a.Path,
+		Message: fmt.Sprintf("Job '%s' was archived on %s to '%s'", a.Id, a.ArchivedAt.Format(time.RFC3339), a.Path)})
+}
+
+// logInternalError reports an unexpected error to the client and logs
+// the details on the server side.
+func logInternalError(w http.ResponseWriter, userMsg, serverMsg string) {
+	writeError(w, http.StatusInternalServerError, &APIError{Code: CodeInternal, Message: userMsg})
+	slog.Error(serverMsg)
+}
+
+// reportError converts an error returned by a job or the index into
+// the matching error response. userMsg describes the failing operation
+// when the error is internal.
+func reportError(w http.ResponseWriter, err error, jobId, userMsg string) {
+	switch e := err.(type) {
+	case *StatusError:
+		writeError(w, http.StatusConflict, &APIError{Code: CodeBadStatus, Message: e.Error(), Job: jobId,
+			Expected: e.Expected.String(), Actual: e.Got.String()})
+	case *AttemptError:
+		writeError(w, http.StatusConflict, &APIError{Code: CodeAttemptOver, Message: e.Error(), Job: jobId,
+			Actual: e.Status.String()})
+	case *IdError:
+		writeError(w, http.StatusBadRequest, &APIError{Code: CodeInvalidParameter, Message: e.Error(), Job: jobId})
+	case *ConflictError:
+		code := CodeJobExists
+		if e.Result != "" {
+			code = CodeResultExists
+		}
+		writeError(w, http.StatusConflict, &APIError{Code: code, Message: e.Error(), Job: e.Job, Result: e.Result})
+	case *WorkerError:
+		if e.Busy {
+			writeError(w, http.StatusConflict, &APIError{Code: CodeWorkerBusy, Message: e.Error(), Job: jobId})
+		} else {
+			workerNotFound(w, e.Name)
+		}
+	case *QuotaError:
+		//Too many jobs or submissions, or not enough storage
+		status := http.StatusTooManyRequests
+		if e.What == "bytes" {
+			status = http.StatusInsufficientStorage
+		}
+		if e.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter(e.RetryAfter)))
+		}
+		writeError(w, status, &APIError{Code: CodeQuotaExceeded, Message: e.Error(), Job: jobId})
+	case *os.PathError, *os.LinkError:
+		//Error on the fs
+		writeError(w, http.StatusInternalServerError, &APIError{Code: CodeStorage, Message: userMsg, Job: jobId})
+		slog.Error(userMsg, "job", jobId, "error", err)
+	default:
+		logInternalError(w, userMsg, userMsg+": "+err.Error())
+	}
+}
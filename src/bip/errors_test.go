@@ -0,0 +1,39 @@
+/**
+ * Errors reported by the REST API.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	for _, x := range []struct {
+		wait time.Duration
+		secs int
+	}{
+		{0, 1},
+		{time.Millisecond, 1},
+		{999 * time.Millisecond, 1},
+		{time.Second, 1},
+		{1001 * time.Millisecond, 2},
+		{90 * time.Second, 90},
+	} {
+		if got := retryAfter(x.wait); got != x.secs {
+			t.Errorf("%s: got %d, expected %d", x.wait, got, x.secs)
+		}
+	}
+}
+
+// A quota exceeded for less than a second must not be retried at once.
+func TestQuotaErrorRetryAfter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	reportError(rec, &QuotaError{Scope: "submitter", Name: "alice", What: "rate", Limit: 10, RetryAfter: 200 * time.Millisecond}, "j", "")
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After '%s', expected '1'", got)
+	}
+}
@@ -0,0 +1,185 @@
+/**
+ * Fair sharing of the ready jobs among their submitters.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// noShare is the share of the jobs without submitter, or without label.
+const noShare = "-"
+
+// dimension returns the dimension the jobs are shared across. Without
+// fair share, the jobs are still counted per submitter.
+func (c FairShareConfig) dimension() string {
+	if c.By == "" {
+		return "submitter"
+	}
+	return c.By
+}
+
+func (c FairShareConfig) weight(share string) int {
+	if w, ok := c.Weights[share]; ok {
+		return w
+	}
+	return 1
+}
+
+func (c FairShareConfig) maxRunning(share string) int {
+	if n, ok := c.Caps[share]; ok {
+		return n
+	}
+	return c.MaxRunning
+}
+
+// shareKey returns the share of a job: its submitter, or its first label.
+func shareKey(j *Job, by string) string {
+	k := j.submitter
+	if by == "label" {
+		k = ""
+		if len(j.labels) > 0 {
+			k = j.labels[0]
+		}
+	}
+	if k == "" {
+		return noShare
+	}
+	return k
+}
+
+// roundRobin hands out the ready jobs in weighted round-robin: a share
+// gets as many jobs in a row as its weight, then the next share in
+// alphabetical order gets its turn. The shares without a ready job that
+// fits, or processing as many jobs as allowed, are skipped.
+type roundRobin struct {
+	//The share having its turn, and the jobs it can still get
+	cur    string
+	credit int
+	//The number of jobs handed out per share
+	count map[string]int
+}
+
+func newRoundRobin() *roundRobin {
+	return &roundRobin{count: make(map[string]int)}
+}
+
+// pick returns the ready job to process, if any. Within a share, the
+// job ready for the longest time comes first.
+func (f *roundRobin) pick(jobs map[string]*Job, c FairShareConfig, o Offer, held map[string]int64, now time.Time) *Job {
+	heads := make(map[string]*Job)
+	running := make(map[string]int)
+	for _, j := range jobs {
+		k := shareKey(j, c.By)
+		switch j.Status() {
+		case processing, terminating:
+			running[k]++
+		case ready:
+			//Jobs past their deadline expire on the next tick of the scheduler
+			if j.pastDeadline(now) || !j.reqs.fits(o, held) {
+				continue
+			}
+			if c.By == "" {
+				return j
+			}
+			if h, ok := heads[k]; !ok || j.Since().Before(h.Since()) {
+				heads[k] = j
+			}
+		}
+	}
+	eligible := make([]string, 0, len(heads))
+	for k := range heads {
+		if max := c.maxRunning(k); max == 0 || running[k] < max {
+			eligible = append(eligible, k)
+		}
+	}
+	if len(eligible) == 0 {
+		return nil
+	}
+	sort.Strings(eligible)
+	i := sort.SearchStrings(eligible, f.cur)
+	if f.credit <= 0 || i == len(eligible) || eligible[i] != f.cur {
+		//The turn of the next share
+		if i < len(eligible) && eligible[i] == f.cur {
+			i++
+		}
+		f.cur = eligible[i%len(eligible)]
+		f.credit = c.weight(f.cur)
+	}
+	return heads[f.cur]
+}
+
+// served records a share got a job.
+func (f *roundRobin) served(share string) {
+	if share == f.cur {
+		f.credit--
+	}
+	f.count[share]++
+}
+
+// ShareStats describes the jobs of a share.
+type ShareStats struct {
+	Name       string `json:"name"`
+	Weight     int    `json:"weight"`
+	MaxRunning int    `json:"max_running"`
+	//The queue depth
+	Ready     int `json:"ready"`
+	Scheduled int `json:"scheduled"`
+	//The jobs processing or terminating
+	Running int `json:"running"`
+	//The number of jobs handed out since bipd started
+	Served int `json:"served"`
+}
+
+// Stats describes how the jobs are shared.
+type Stats struct {
+	FairShare bool         `json:"fair_share"`
+	By        string       `json:"by"`
+	Shares    []ShareStats `json:"shares"`
+}
+
+// Stats reports the jobs of each share, sorted by name.
+func (idx *Index) Stats() Stats {
+	c := currentFairShare()
+	by := c.dimension()
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	shares := make(map[string]*ShareStats)
+	get := func(k string) *ShareStats {
+		s, ok := shares[k]
+		if !ok {
+			s = &ShareStats{Name: k, Weight: c.weight(k), MaxRunning: c.maxRunning(k), Served: idx.share.count[k]}
+			shares[k] = s
+		}
+		return s
+	}
+	for k := range idx.share.count {
+		get(k)
+	}
+	for _, j := range idx.jobs {
+		switch j.Status() {
+		case ready:
+			get(shareKey(j, by)).Ready++
+		case scheduled:
+			get(shareKey(j, by)).Scheduled++
+		case processing, terminating:
+			get(shareKey(j, by)).Running++
+		}
+	}
+	res := Stats{FairShare: c.By != "", By: by, Shares: make([]ShareStats, 0, len(shares))}
+	for _, s := range shares {
+		res.Shares = append(res.Shares, *s)
+	}
+	sort.Slice(res.Shares, func(a, b int) bool { return res.Shares[a].Name < res.Shares[b].Name })
+	return res
+}
+
+func GetStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(idx.Stats())
+}
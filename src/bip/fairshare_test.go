@@ -0,0 +1,70 @@
+/**
+ * Fair sharing of the ready jobs among their submitters.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"testing"
+	"time"
+)
+
+// The shares get as many jobs in a row as their weight, in alphabetical
+// order, while they are below their cap.
+func TestRoundRobin(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		conf FairShareConfig
+		//The jobs of each submitter, and the ones already processed
+		ready   map[string]int
+		running map[string]int
+		picked  string
+	}{
+		{"alternate", FairShareConfig{By: "submitter"}, map[string]int{"a": 3, "b": 3}, nil, "ababab"},
+		{"weights", FairShareConfig{By: "submitter", Weights: map[string]int{"a": 2}}, map[string]int{"a": 4, "b": 2}, nil, "aabaab"},
+		{"drained", FairShareConfig{By: "submitter"}, map[string]int{"a": 1, "b": 3}, nil, "abbb"},
+		{"max running", FairShareConfig{By: "submitter", MaxRunning: 1}, map[string]int{"a": 2, "b": 2}, map[string]int{"a": 1}, "b"},
+		{"caps", FairShareConfig{By: "submitter", MaxRunning: 1, Caps: map[string]int{"a": 2}}, map[string]int{"a": 2, "b": 2}, map[string]int{"a": 1, "b": 1}, "a"},
+	} {
+		idx, err := NewIndex(t.TempDir(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for s, n := range tc.running {
+			for i := 0; i < n; i++ {
+				id := s + "-processing-" + string(rune('0'+i))
+				if err = idx.NewJob(id, nil, JobSpec{Submitter: s}, System); err != nil {
+					t.Fatal(err)
+				}
+				j, _ := idx.GetJob(id)
+				if err = j.Process("", System); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		for s, n := range tc.ready {
+			for i := 0; i < n; i++ {
+				if err = idx.NewJob(s+"-"+string(rune('0'+i)), nil, JobSpec{Submitter: s}, System); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		f := newRoundRobin()
+		picked := ""
+		for {
+			j := f.pick(idx.jobs, tc.conf, Offer{}, nil, time.Now())
+			if j == nil {
+				break
+			}
+			if err = j.Process("", System); err != nil {
+				t.Fatal(err)
+			}
+			f.served(j.Submitter())
+			picked += j.Submitter()
+		}
+		if picked != tc.picked {
+			t.Errorf("%s: picked '%s', expected '%s'", tc.name, picked, tc.picked)
+		}
+	}
+}
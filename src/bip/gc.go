@@ -0,0 +1,210 @@
+/**
+ * Retention of the finished jobs.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Prefix of the directories of the jobs being deleted.
+const gcPrefix = ".gc-"
+
+// Collected is a job deleted or archived by the garbage collector, and why.
+type Collected struct {
+	Id     string `json:"id"`
+	Status string `json:"status"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+	//The archive of the job, when archived rather than deleted
+	Archive string `json:"archive,omitempty"`
+}
+
+// Collection reports a run of the garbage collector.
+type Collection struct {
+	DryRun bool        `json:"dry_run"`
+	Jobs   []Collected `json:"jobs"`
+	Bytes  int64       `json:"bytes"`
+}
+
+// retentionCandidates returns the jobs to delete according to the
+// retention rules, with the reason.
+func (idx *Index) retentionCandidates(rules RetentionConfig, now time.Time) map[*Job]string {
+	res := make(map[*Job]string)
+	byLabel := make(map[string][]*Job)
+	for _, j := range idx.jobs {
+		if !j.finished() || (rules.PinLabel != "" && j.HasLabel(rules.PinLabel)) {
+			continue
+		}
+		age := now.Sub(j.Since())
+		if j.Status() == failed || j.Status() == expired {
+			//Failed and expired jobs are only subject to their own age limit
+			if rules.failedMaxAge > 0 && age > rules.failedMaxAge {
+				res[j] = "failed_max_age"
+			}
+			continue
+		}
+		if rules.maxAge > 0 && age > rules.maxAge {
+			res[j] = "max_age"
+			continue
+		}
+		for _, l := range j.Labels() {
+			byLabel[l] = append(byLabel[l], j)
+		}
+	}
+	if rules.MaxPerLabel == 0 {
+		return res
+	}
+	for l, jobs := range byLabel {
+		if len(jobs) <= rules.MaxPerLabel {
+			continue
+		}
+		//Keep the most recent ones
+		sort.Slice(jobs, func(a, b int) bool { return jobs[a].Since().After(jobs[b].Since()) })
+		for _, j := range jobs[rules.MaxPerLabel:] {
+			if _, ok := res[j]; !ok {
+				res[j] = "max_per_label:" + l
+			}
+		}
+	}
+	return res
+}
+
+// diskUsage returns the number of bytes stored below a directory.
+func diskUsage(root string) int64 {
+	var size int64
+	filepath.Walk(root, func(p string, stat os.FileInfo, err error) error {
+		if err == nil && stat.Mode().IsRegular() {
+			size += stat.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// Collect deletes, or archives, the finished jobs according to the
+// retention rules. In dry-run mode, the jobs are only reported.
+func (idx *Index) Collect(dryRun bool, by Actor) (*Collection, error) {
+	idx.collecting.Lock()
+	defer idx.collecting.Unlock()
+	rules := currentRetention()
+	c := &Collection{DryRun: dryRun, Jobs: make([]Collected, 0)}
+	idx.lock.RLock()
+	candidates := idx.retentionCandidates(rules, time.Now())
+	idx.lock.RUnlock()
+	var err error
+	for j, reason := range candidates {
+		x := Collected{Id: j.Id(), Status: j.Status().String(), Size: diskUsage(j.root), Reason: reason}
+		if !dryRun {
+			if rules.Archive {
+				var a *Archived
+				if a, err = idx.Archive(j, by); err != nil {
+					break
+				}
+				x.Archive = a.Path
+			} else if err = idx.remove(j, by, "deleted"); err != nil {
+				break
+			}
+		}
+		c.Jobs = append(c.Jobs, x)
+		c.Bytes += x.Size
+	}
+	sort.Slice(c.Jobs, func(a, b int) bool { return c.Jobs[a].Id < c.Jobs[b].Id })
+	if !dryRun {
+		metrics.collected(len(c.Jobs), c.Bytes)
+	}
+	return c, err
+}
+
+// remove takes a job out of the index and deletes its directory. to is
+// the state recorded in the audit log.
+func (idx *Index) remove(j *Job, by Actor, to string) error {
+	idx.lock.Lock()
+	if idx.jobs[j.Id()] != j {
+		idx.lock.Unlock()
+		return fmt.Errorf("Job '%s' is no longer in the index", j.Id())
+	}
+	//Renaming is atomic, the removal can be resumed on restart. The name
+	//is unique as a removal that failed may have left the previous one
+	p := idx.root + "/" + gcPrefix + j.Id() + "-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := os.Rename(j.root, p); err != nil {
+		idx.lock.Unlock()
+		return err
+	}
+	delete(idx.jobs, j.Id())
+	idx.quotas.account(j, -1)
+	if o := j.Owner(); o != "" {
+		idx.workers.release(o, j.Id(), creating)
+	}
+	idx.audit.record(by, j.Id(), j.Status().String(), to)
+	idx.lock.Unlock()
+	return os.RemoveAll(p)
+}
+
+// StartCollector runs the garbage collector in background, at the
+// interval set by the retention rules.
+func (idx *Index) StartCollector() {
+	idx.stop = make(chan struct{})
+	idx.stopped = make(chan struct{})
+	go func() {
+		defer close(idx.stopped)
+		for {
+			rules := currentRetention()
+			wait := rules.interval
+			if wait == 0 {
+				//Disabled, check again later in case of a reload
+				wait = time.Minute
+			}
+			select {
+			case <-idx.stop:
+				return
+			case <-time.After(wait):
+			}
+			if rules.interval == 0 {
+				continue
+			}
+			c, err := idx.Collect(rules.DryRun, System)
+			if err != nil {
+				slog.Error("garbage collection failed", "error", err)
+			}
+			if c != nil && len(c.Jobs) > 0 {
+				slog.Info("garbage collection", "dry_run", c.DryRun, "jobs", len(c.Jobs), "bytes", c.Bytes)
+				for _, x := range c.Jobs {
+					slog.Debug("garbage collection", "dry_run", c.DryRun, "job", x.Id, "reason", x.Reason, "bytes", x.Size)
+				}
+			}
+		}
+	}()
+}
+
+// StopCollector stops the garbage collector, once the current collection is over.
+func (idx *Index) StopCollector() {
+	if idx.stop == nil {
+		return
+	}
+	close(idx.stop)
+	<-idx.stopped
+}
+
+// CollectJobs runs the garbage collector. The 'dry_run' parameter only
+// reports the jobs to delete.
+func CollectJobs(w http.ResponseWriter, r *http.Request) {
+	c, err := idx.Collect(r.URL.Query().Get("dry_run") != "", actor(r))
+	if err != nil {
+		reportError(w, err, "", "Unable to delete the finished jobs")
+		return
+	}
+	logger(r).Info("garbage collection", "dry_run", c.DryRun, "jobs", len(c.Jobs), "bytes", c.Bytes)
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
@@ -0,0 +1,132 @@
+/**
+ * Health and readiness of bipd.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// The free space, in bytes, required on the storage root for bipd to be
+// ready. Set by ApplyConfig
+var minFreeSpace uint64 = 100 << 20
+
+var (
+	startedAt = time.Now()
+	//Closed once the index is available
+	loaded       = make(chan struct{})
+	shuttingDown int32
+	//Closed once bipd is shutting down
+	stopping = make(chan struct{})
+)
+
+// SetIndex provides the index to the REST API once it is loaded.
+func SetIndex(i *Index) {
+	idx = i
+	close(loaded)
+}
+
+// indexLoaded indicates if the index is available.
+func indexLoaded() bool {
+	select {
+	case <-loaded:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetShuttingDown signals bipd is stopping, so it is no longer ready.
+func SetShuttingDown() {
+	if atomic.CompareAndSwapInt32(&shuttingDown, 0, 1) {
+		close(stopping)
+	}
+}
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// Check is the outcome of a readiness check.
+type Check struct {
+	Ok      bool        `json:"ok"`
+	Message string      `json:"message,omitempty"`
+	Value   interface{} `json:"value,omitempty"`
+}
+
+// requireIndex answers 503 while the index is loading.
+func requireIndex(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !indexLoaded() {
+			w.Header().Set("retry-after", "5")
+			writeError(w, http.StatusServiceUnavailable, &APIError{Code: CodeUnavailable, Message: "The index is loading"})
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// GetHealth tells the process is alive.
+func GetHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "ok",
+		"uptime": time.Since(startedAt).String(),
+	})
+}
+
+// GetReadiness tells if bipd can serve requests: the index is loaded,
+// the storage root is writable with enough free space and bipd is not
+// shutting down.
+func GetReadiness(w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]Check)
+	checks["shutdown"] = Check{Ok: !isShuttingDown()}
+	if !indexLoaded() {
+		checks["index"] = Check{Ok: false, Message: "loading"}
+	} else {
+		checks["index"] = Check{Ok: true, Value: len(idx.ListJobs())}
+		checks["storage"] = checkWritable(idx.root)
+		checks["disk"] = checkFreeSpace(idx.root)
+	}
+	status := "ok"
+	code := http.StatusOK
+	for _, c := range checks {
+		if !c.Ok {
+			status = "unavailable"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "checks": checks})
+}
+
+func checkWritable(root string) Check {
+	f, err := ioutil.TempFile(root, ".readyz")
+	if err != nil {
+		return Check{Ok: false, Message: err.Error()}
+	}
+	f.Close()
+	if err = os.Remove(f.Name()); err != nil {
+		return Check{Ok: false, Message: err.Error()}
+	}
+	return Check{Ok: true}
+}
+
+func checkFreeSpace(root string) Check {
+	free, err := freeSpace(root)
+	if err != nil {
+		return Check{Ok: false, Message: err.Error()}
+	}
+	if free < currentMinFreeSpace() {
+		return Check{Ok: false, Value: free, Message: "free space below the threshold"}
+	}
+	return Check{Ok: true, Value: free}
+}
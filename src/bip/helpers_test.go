@@ -0,0 +1,69 @@
+/**
+ * Helpers shared by the tests.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A job to create, and the status and the results to lead it to.
+type fixture struct {
+	id      string
+	spec    JobSpec
+	to      JobStatus
+	results map[string]string
+}
+
+var fixtures = []fixture{
+	{"ready", JobSpec{Labels: []string{"nightly", "big"}}, ready, nil},
+	{"scheduled", JobSpec{NotBefore: time.Now().Add(time.Hour).UTC()}, scheduled, nil},
+	{"running", JobSpec{Policy: JobPolicy{Timeout: time.Hour, Retries: 2}, Submitter: "alice"}, processing, nil},
+	{"uploading", JobSpec{}, terminating, map[string]string{"partial.txt": "half"}},
+	{"done", JobSpec{Labels: []string{"nightly"}}, terminated, map[string]string{
+		"out.txt":            "42",
+		"plots/cpu.png":      "cpu",
+		"plots/2024/mem.png": "mem",
+	}},
+	{"failed", JobSpec{}, failed, nil},
+}
+
+// lead creates a job and leads it to its status, with its results.
+func lead(t *testing.T, idx *Index, f fixture) *Job {
+	if err := idx.NewJob(f.id, []byte("data of "+f.id), f.spec, System); err != nil {
+		t.Fatalf("%s: %s", f.id, err)
+	}
+	j, _ := idx.GetJob(f.id)
+	steps := map[JobStatus][]func(Actor) error{
+		ready:       nil,
+		scheduled:   nil,
+		processing:  {func(by Actor) error { return j.Process("", by) }},
+		terminating: {func(by Actor) error { return j.Process("", by) }, j.Terminating},
+		terminated:  {func(by Actor) error { return j.Process("", by) }, j.Terminating},
+		failed:      {func(by Actor) error { return j.Process("", by) }, j.Failed},
+	}
+	for _, step := range steps[f.to] {
+		if err := step(System); err != nil {
+			t.Fatalf("%s: %s", f.id, err)
+		}
+	}
+	for r, cnt := range f.results {
+		info := Result{ContentType: "text/plain", Filename: filepath.Base(r), Metadata: map[string]string{"from": f.id}}
+		if err := j.AddResult(r, []byte(cnt), info); err != nil {
+			t.Fatalf("%s: %s", f.id, err)
+		}
+	}
+	if f.to == terminated {
+		if err := j.Terminated(System); err != nil {
+			t.Fatalf("%s: %s", f.id, err)
+		}
+	}
+	if s := j.Status(); s != f.to {
+		t.Fatalf("%s: status '%s', expected '%s'", f.id, s, f.to)
+	}
+	return j
+}
@@ -6,81 +6,238 @@
 package bip
 
 import (
-	"os"
 	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Index struct {
-	jobs map[string]*Job
-	root string
+	lock  sync.RWMutex
+	jobs  map[string]*Job
+	root  string
+	audit *AuditLog
+	//The directory of the archives, and the archived jobs
+	archive  string
+	archived map[string]*Archived
+	//Serialize the archival operations, and the removals of jobs
+	archiveLock sync.Mutex
+	collecting  sync.Mutex
+	//Blocks the changes of the jobs during a snapshot
+	frozen sync.RWMutex
+	//Promotes the scheduled jobs and enforces the limits of the jobs
+	wheel            *timerWheel
+	stopScheduler    chan struct{}
+	schedulerStopped chan struct{}
+	//The workers processing the jobs
+	workers *registry
+	//Shares the ready jobs among the submitters
+	share *roundRobin
+	//The usage of the submitters and of the queues
+	quotas *ledger
+	//The recurring jobs, by name
+	crons    map[string]*Cron
+	cronLock sync.Mutex
+	//Closed to stop the garbage collector, which then closes stopped
+	stop    chan struct{}
+	stopped chan struct{}
 }
 
+// NewIndex loads the jobs stored in root. Archived jobs are stored in
+// archive, '<root>/.archive' if empty.
+func NewIndex(root, archive string) (*Index, error) {
 
-func NewIndex(root string) (*Index, error) {
-
-	idx := &Index{make(map[string]*Job), root}
+	idx := &Index{jobs: make(map[string]*Job), root: root, wheel: newTimerWheel(time.Now()), workers: newRegistry(),
+		share: newRoundRobin(), quotas: newLedger()}
 	stat, err := os.Stat(root)
-	if (err != nil) {
+	if err != nil {
 		err = os.MkdirAll(root, 0700)
 		if err != nil {
 			return nil, err
 		}
-	} else if (stat.IsDir()) {
+	} else if stat.IsDir() {
 		cnt, err := ioutil.ReadDir(root)
-		if (err != nil) {
+		if err != nil {
 			return nil, err
 		}
-		for _,e := range cnt {
+		for _, e := range cnt {
+			if strings.HasPrefix(e.Name(), ".") {
+				//Not a job. Jobs being deleted when bipd stopped are removed
+				if strings.HasPrefix(e.Name(), gcPrefix) || strings.HasPrefix(e.Name(), restorePrefix) {
+					os.RemoveAll(root + "/" + e.Name())
+				}
+				continue
+			}
 			stat, err = os.Stat(root + "/" + e.Name())
-			if (err == nil && stat.IsDir()) {
-				err = idx.addJob(e.Name());
-				if (err != nil) {
+			if err == nil && stat.IsDir() {
+				err = idx.addJob(e.Name())
+				if err != nil {
 					return nil, err
 				}
 			}
 		}
 	}
+	if idx.audit, err = OpenAuditLog(root + "/" + auditFile); err != nil {
+		return nil, err
+	}
+	for _, j := range idx.jobs {
+		idx.attach(j)
+	}
+	if err = idx.loadCrons(); err != nil {
+		return nil, err
+	}
+	if err = idx.openArchive(archiveDir(root, archive)); err != nil {
+		return nil, err
+	}
+	metrics.seed(idx)
 	return idx, nil
 }
 
-func (idx * Index) ListJobs() []string {
+func (idx *Index) ListJobs() []string {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
 	keys := make([]string, 0)
-	for k,_ := range(idx.jobs) {
+	for k, _ := range idx.jobs {
 		keys = append(keys, k)
 	}
 	return keys
 }
 
-func (idx * Index) GetJob(id string) (*Job, bool) {
+func (idx *Index) GetJob(id string) (*Job, bool) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
 	j, ok := idx.jobs[id]
 	return j, ok
 }
 
-func (idx * Index) addJob(id string) error {
-	j,err := ResumeJob(idx.root + "/" + id, id)
-	if (err != nil) {
+func (idx *Index) addJob(id string) error {
+	j, err := ResumeJob(idx.root+"/"+id, id)
+	if err != nil {
 		return err
 	}
 	idx.jobs[id] = j
 	return nil
 }
 
-func (idx * Index) NewJob(id string, data []byte) error {
-	j,err := NewJob(idx.root + "/" + id, id, data)
-	if (err != nil) {
+// NewJob creates a job. It is scheduled until spec.NotBefore if set. The
+// submitter is the actor, unless stated.
+func (idx *Index) NewJob(id string, data []byte, spec JobSpec, by Actor) error {
+	if err := CheckJobId(id); err != nil {
+		return err
+	}
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	//Archiving the job would replace the tarball of the archived one
+	if _, ok := idx.archived[id]; ok {
+		return &ConflictError{Job: id, Archived: true}
+	}
+	if spec.Submitter == "" {
+		spec.Submitter = by.Who
+	}
+	now := time.Now()
+	if err := idx.quotas.admit(spec.Submitter, spec.Labels, int64(len(data)), now); err != nil {
 		return err
 	}
+	j, err := NewJob(idx.root+"/"+id, id, data, spec)
+	if err != nil {
+		return err
+	}
+	idx.attach(j)
+	idx.quotas.submitted(j, now)
+	idx.audit.record(by, id, "", j.Status().String())
 	idx.jobs[id] = j
+	metrics.pushed()
 	return nil
 }
 
-func (idx * Index) ProcessFirstReady() (*Job, error) {
-	for _,j := range idx.jobs {
-		if (j.Status() == ready) {
-			err := j.Process()
-			return j, err
+// attach connects a job to the index: its audit log, its timers, the
+// registry of the workers and the quotas.
+func (idx *Index) attach(j *Job) {
+	j.audit = idx.audit
+	j.frozen = &idx.frozen
+	j.wheel = idx.wheel
+	j.workers = idx.workers
+	j.quotas = idx.quotas
+	idx.quotas.account(j, 1)
+	j.arm()
+}
+
+// ProcessFirstReady hands the first ready job that fits the offer to a
+// worker, if named. The resources held by the jobs the worker is already
+// processing are not available. A worker presenting no resources keeps
+// its previous offer.
+func (idx *Index) ProcessFirstReady(worker string, o Offer, by Actor) (*Job, error) {
+	var held map[string]int64
+	if worker != "" {
+		o, held = idx.workers.offer(worker, o)
+	}
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	c := currentFairShare()
+	j := idx.share.pick(idx.jobs, c, o, held, time.Now())
+	if j == nil {
+		return nil, nil
+	}
+	err := j.Process(worker, by)
+	if err == nil {
+		idx.share.served(shareKey(j, c.dimension()))
+	}
+	return j, err
+}
+
+// Select returns the jobs having the given status and label. An empty
+// status or label matches every job.
+func (idx *Index) Select(status, label string) []*Job {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	res := make([]*Job, 0)
+	for _, j := range idx.jobs {
+		if status != "" && j.Status().String() != status {
+			continue
+		}
+		if label != "" && !j.HasLabel(label) {
+			continue
+		}
+		res = append(res, j)
+	}
+	return res
+}
+
+// Delete removes a job and its results, whatever its status.
+func (idx *Index) Delete(j *Job, by Actor) error {
+	idx.collecting.Lock()
+	defer idx.collecting.Unlock()
+	return idx.remove(j, by, "deleted")
+}
+
+// Sync flushes the state of every job to the disk.
+func (idx *Index) Sync() error {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	for _, j := range idx.jobs {
+		if err := j.sync(); err != nil {
+			return err
 		}
 	}
-	return nil, nil
+	if err := idx.audit.Sync(); err != nil {
+		return err
+	}
+	return syncPath(idx.root)
 }
 
+// History returns the state changes of a job, oldest first.
+func (idx *Index) History(id string) ([]AuditEntry, error) {
+	return idx.audit.History(id)
+}
+
+// CountByStatus returns the number of jobs per status.
+func (idx *Index) CountByStatus() map[string]int {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	res := make(map[string]int)
+	for _, j := range idx.jobs {
+		res[j.Status().String()]++
+	}
+	return res
+}
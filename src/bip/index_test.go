@@ -0,0 +1,67 @@
+/**
+ * Index of the jobs.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The identifiers that do not name a plain directory of the storage root
+// must be refused, and nothing must be written outside of it.
+func TestNewJobRejectsInvalidIds(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	idx, err := NewIndex(root, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"", ".x", ".gc-x", ".restore-x", "..", "../x", "a/b", "a b", "a\tb", "a\nb"} {
+		err := idx.NewJob(id, []byte("data"), JobSpec{}, System)
+		if _, ok := err.(*IdError); !ok {
+			t.Errorf("'%s': got '%v', expected an invalid identifier", id, err)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(base, "x")); !os.IsNotExist(err) {
+		t.Errorf("a job was created outside of the storage root")
+	}
+	if len(idx.ListJobs()) != 0 {
+		t.Errorf("jobs %v, expected none", idx.ListJobs())
+	}
+	for _, id := range []string{"a", "a.b", "a-1_2", "x..y"} {
+		if err = idx.NewJob(id, []byte("data"), JobSpec{}, System); err != nil {
+			t.Errorf("'%s': %s", id, err)
+		}
+	}
+}
+
+// A directory left by a previous removal of the same identifier must not
+// prevent the removal of the job.
+func TestDeleteWithStaleRemoval(t *testing.T) {
+	root := t.TempDir()
+	idx, err := NewIndex(root, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join(root, gcPrefix+"j")
+	if err = os.MkdirAll(filepath.Join(stale, "results"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = idx.NewJob("j", []byte("data"), JobSpec{}, System); err != nil {
+		t.Fatal(err)
+	}
+	j, _ := idx.GetJob("j")
+	if err = idx.Delete(j, System); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := idx.GetJob("j"); ok {
+		t.Errorf("the job is still in the index")
+	}
+	if _, err = os.Stat(filepath.Join(root, "j")); !os.IsNotExist(err) {
+		t.Errorf("the job directory is still there")
+	}
+}
@@ -6,46 +6,158 @@
 package bip
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
-	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type JobStatus byte
 
 const (
-	creating = 0
-	ready = 1
-	processing = 2
+	creating    = 0
+	ready       = 1
+	processing  = 2
 	terminating = 3
-	terminated = 4
+	terminated  = 4
+	failed      = 5
+	scheduled   = 6
+	expired     = 7
 )
 
 func (s JobStatus) String() string {
-	switch(s) {
-		case 0: return fmt.Sprintf("creating")
-		case 1: return fmt.Sprintf("ready")
-		case 2: return fmt.Sprintf("processing")
-		case 3: return fmt.Sprintf("terminating")
-		case 4: return fmt.Sprintf("terminated")
+	switch s {
+	case 0:
+		return fmt.Sprintf("creating")
+	case 1:
+		return fmt.Sprintf("ready")
+	case 2:
+		return fmt.Sprintf("processing")
+	case 3:
+		return fmt.Sprintf("terminating")
+	case 4:
+		return fmt.Sprintf("terminated")
+	case 5:
+		return fmt.Sprintf("failed")
+	case 6:
+		return fmt.Sprintf("scheduled")
+	case 7:
+		return fmt.Sprintf("expired")
 	}
 	return fmt.Sprintf("%d", s)
 }
 
 type StatusError struct {
 	Expected JobStatus
-	Got JobStatus
+	Got      JobStatus
 }
 
 func (err *StatusError) Error() string {
-	return fmt.Sprintf("Expected status updated to '%s'. Got '%s'.", err.Expected.String(), err.Got.String())
+	return fmt.Sprintf("Expected status '%s'. Got '%s'.", err.Expected.String(), err.Got.String())
+}
+
+// ConflictError reports that a job or a result identifier is already used.
+type ConflictError struct {
+	Job    string
+	Result string
+	//The existing result the new one collides with, if not Result itself
+	With string
+	//The job identifier is used by an archived job
+	Archived bool
+}
+
+func (err *ConflictError) Error() string {
+	if err.Archived {
+		return fmt.Sprintf("Job '%s' is archived", err.Job)
+	} else if err.Result == "" {
+		return fmt.Sprintf("Job '%s' already exists", err.Job)
+	} else if err.With != "" {
+		return fmt.Sprintf("Result id '%s' conflicts with result '%s'", err.Result, err.With)
+	}
+	return fmt.Sprintf("Result id '%s' already used", err.Result)
+}
+
+// Result describes a stored result: its content type, an optional
+// filename to suggest to the clients and free-form metadata.
+type Result struct {
+	ContentType string            `json:"content_type"`
+	Filename    string            `json:"filename,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Size        int64             `json:"size"`
+}
+
+const defaultContentType = "application/octet-stream"
+
+// JobPolicy bounds the life of a job. Zero values mean no limit.
+type JobPolicy struct {
+	//The maximum processing duration, and how many times a job exceeding
+	//it is made ready again before failing
+	Timeout time.Duration `json:"timeout,omitempty"`
+	Retries int           `json:"retries,omitempty"`
+	//The moment a job that is not processed yet expires
+	Deadline time.Time `json:"deadline,omitempty"`
+}
+
+func (p JobPolicy) isZero() bool {
+	return p.Timeout == 0 && p.Retries == 0 && p.Deadline.IsZero()
+}
+
+// JobSpec describes a job to create, besides its data.
+type JobSpec struct {
+	Labels []string
+	//The moment the job becomes ready, if delayed
+	NotBefore    time.Time
+	Policy       JobPolicy
+	Requirements Requirements
+	//The identity of the client that submitted the job
+	Submitter string
 }
 
 type Job struct {
 	root string
-	status JobStatus
-	results map[string]bool
-	id string
+	//Protects the status, the attempts, the owner and the results
+	lock    sync.Mutex
+	status  JobStatus
+	results map[string]*Result
+	id      string
+	labels  []string
+	//The moment the job entered its current status
+	since time.Time
+	//The moment the job started to be processed, if known
+	started time.Time
+	//The moment a scheduled job becomes ready, if any
+	notBefore time.Time
+	policy    JobPolicy
+	reqs      Requirements
+	submitter string
+	//The size of the data
+	dataSize int64
+	//The number of times the job was processed
+	attempts int
+	audit    *AuditLog
+	//Held for reading while the job changes, see Index.Snapshot
+	frozen *sync.RWMutex
+	//Enforces the delays and the limits of the job, if set
+	wheel *timerWheel
+	//The worker processing the job, if known
+	owner   string
+	workers *registry
+	quotas  *ledger
+	//The last progress updates, oldest first
+	progress     []Progress
+	progressLock sync.Mutex
+	//The size of the logs, and a channel closed once logs are appended
+	logsSize  int64
+	logSignal chan struct{}
+	logLock   sync.Mutex
+	//Closed once the current attempt is over. Protected by lock
+	attemptEnd chan struct{}
 }
 
 func (j *Job) Id() string {
@@ -53,127 +165,674 @@ func (j *Job) Id() string {
 }
 
 func (j *Job) Status() JobStatus {
+	j.lock.Lock()
+	defer j.lock.Unlock()
 	return j.status
 }
 
+// Since returns the moment the job entered its current status.
+func (j *Job) Since() time.Time {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.since
+}
+
+// NotBefore returns the moment the job can be processed. It is zero
+// unless the job was delayed.
+func (j *Job) NotBefore() time.Time {
+	return j.notBefore
+}
+
+// Policy returns the limits of the job.
+func (j *Job) Policy() JobPolicy {
+	return j.policy
+}
+
+// Requirements returns the resources and the constraints of the job.
+func (j *Job) Requirements() Requirements {
+	return j.reqs
+}
+
+// Submitter returns the identity of the client that submitted the job, if known.
+func (j *Job) Submitter() string {
+	return j.submitter
+}
+
+// Owner returns the worker processing the job, if known.
+func (j *Job) Owner() string {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.owner
+}
+
+// Attempts returns the number of times the job was processed.
+func (j *Job) Attempts() int {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.attempts
+}
+
+// Labels returns the labels attached to the job at its creation.
+func (j *Job) Labels() []string {
+	return j.labels
+}
+
+// HasLabel indicates if the job is labelled with l.
+func (j *Job) HasLabel(l string) bool {
+	for _, x := range j.labels {
+		if x == l {
+			return true
+		}
+	}
+	return false
+}
+
 func (j *Job) Results() []string {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.resultIds()
+}
+
+// resultIds lists the results. The job must be locked.
+func (j *Job) resultIds() []string {
 	res := make([]string, 0)
-	for  id,_ := range j.results {
+	for id, _ := range j.results {
 		res = append(res, id)
 	}
 	return res
 }
 
 func (j *Job) Result(r string) (bool, []byte, error) {
-	if (j.results[r]) {
+	if _, ok := j.ResultInfo(r); ok {
 		cnt, err := ioutil.ReadFile(j.root + "/results/" + r)
 		return true, cnt, err
 	}
 	return false, nil, nil
 }
 
+// ResultInfo returns the description of a result.
+func (j *Job) ResultInfo(r string) (*Result, bool) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	info, ok := j.results[r]
+	return info, ok
+}
+
+// OpenResult opens the file storing a result.
+func (j *Job) OpenResult(r string) (*os.File, error) {
+	if _, ok := j.ResultInfo(r); !ok {
+		return nil, fmt.Errorf("Result '%s' not found", r)
+	}
+	return os.Open(j.root + "/results/" + r)
+}
+
 func (j *Job) Data() ([]byte, error) {
 	return ioutil.ReadFile(j.root + "/data")
 }
 
-func (j *Job) AddResult(r string, cnt []byte) error {
-	if (j.status != terminating) {
-		return fmt.Errorf("Job should be in state 'terminating'\n")
+// IdError reports a job identifier that cannot name a job.
+type IdError struct {
+	Id string
+}
+
+func (err *IdError) Error() string {
+	return fmt.Sprintf("Invalid job identifier '%s'", err.Id)
+}
+
+// CheckJobId checks a job identifier names a directory of the storage
+// root that is neither hidden, like the directories of bipd, nor nested.
+func CheckJobId(id string) error {
+	if id == "" || strings.HasPrefix(id, ".") || strings.ContainsAny(id, "/ \t\n") {
+		return &IdError{id}
+	}
+	return nil
+}
+
+// CheckResultName checks a result name is a relative, slash-separated
+// path that stays inside the results directory.
+func CheckResultName(r string) error {
+	if r == "" || path.IsAbs(r) || path.Clean(r) != r {
+		return fmt.Errorf("Invalid result name '%s'", r)
 	}
-	if (j.results[r]) {
-		return fmt.Errorf("Result id '%s' already used", r)
+	for _, s := range strings.Split(r, "/") {
+		if s == "." || s == ".." {
+			return fmt.Errorf("Invalid result name '%s'", r)
+		}
 	}
-	err := ioutil.WriteFile(j.root + "/results/" + r, cnt, 0600)
-	if err == nil {
-		j.results[r] = true
+	return nil
+}
+
+// checkResultTree checks a new result does not collide with the
+// existing ones: a result cannot be the directory of another one. The
+// job must be locked.
+func (j *Job) checkResultTree(r string) error {
+	if _, ok := j.results[r]; ok {
+		return &ConflictError{Job: j.id, Result: r}
 	}
-	return err
+	for x, _ := range j.results {
+		if strings.HasPrefix(x, r+"/") || strings.HasPrefix(r, x+"/") {
+			return &ConflictError{Job: j.id, Result: r, With: x}
+		}
+	}
+	return nil
+}
+
+// AddResult stores a result and its description. When no content
+// type is provided, the default one is used. The result identifier
+// may be a path like 'plots/cpu.png'.
+func (j *Job) AddResult(r string, cnt []byte, info Result) error {
+	//The concurrent uploads of a job are serialized
+	return j.locked(func() error {
+		return j.addResult(r, cnt, info)
+	})
 }
 
-func NewJob(root string, id string, data []byte) (*Job, error){
-	stat, err := os.Stat(root);
-	if (err == nil && (stat != nil && stat.IsDir())) {
-		return nil, fmt.Errorf("Error, Job already exists\n")
+func (j *Job) addResult(r string, cnt []byte, info Result) error {
+	if j.status != terminating {
+		return &StatusError{terminating, j.status}
+	}
+	if err := CheckResultName(r); err != nil {
+		return err
+	}
+	if err := j.checkResultTree(r); err != nil {
+		return err
 	}
-	if err = os.MkdirAll(root + "/results", 0700); err != nil {
+	if info.ContentType == "" {
+		info.ContentType = defaultContentType
+	}
+	info.Size = int64(len(cnt))
+	meta, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err = j.quotas.reserve(j, info.Size); err != nil {
+		return err
+	}
+	if err = j.writeResult(r, cnt, meta); err != nil {
+		j.quotas.release(j, info.Size)
+		return err
+	}
+	j.results[r] = &info
+	metrics.resultAdded(info.Size)
+	return nil
+}
+
+func (j *Job) writeResult(r string, cnt, meta []byte) error {
+	if dir := path.Dir(r); dir != "." {
+		if err := os.MkdirAll(j.root+"/meta/"+dir, 0700); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(j.root+"/results/"+dir, 0700); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(j.root+"/meta/"+r, meta, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(j.root+"/results/"+r, cnt, 0600)
+}
+
+// size returns the number of bytes of the data, the results and the logs.
+func (j *Job) size() int64 {
+	j.lock.Lock()
+	size := j.dataSize
+	for _, r := range j.results {
+		size += r.Size
+	}
+	j.lock.Unlock()
+	j.logLock.Lock()
+	defer j.logLock.Unlock()
+	return size + j.logsSize
+}
+
+// readResultInfo reads the description of a result. Results stored
+// without any description get the default content type.
+func readResultInfo(root, r string) (*Result, error) {
+	info := &Result{ContentType: defaultContentType}
+	cnt, err := ioutil.ReadFile(root + "/meta/" + r)
+	if os.IsNotExist(err) {
+		stat, err := os.Stat(root + "/results/" + r)
+		if err != nil {
+			return nil, err
+		}
+		info.Size = stat.Size()
+		return info, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(cnt, info); err != nil {
 		return nil, err
 	}
-	j := &Job{root, 0, make(map[string]bool), id}
+	return info, nil
+}
 
-	if err = j.setStatus(creating); err != nil {
+// NewJob creates a job. It is scheduled if spec.NotBefore is in the future,
+// ready otherwise.
+func NewJob(root string, id string, data []byte, spec JobSpec) (*Job, error) {
+	stat, err := os.Stat(root)
+	if err == nil && (stat != nil && stat.IsDir()) {
+		return nil, &ConflictError{Job: id}
+	}
+	if err = os.MkdirAll(root+"/results", 0700); err != nil {
 		return nil, err
 	}
-	if err = ioutil.WriteFile(root + "/data", data, 0600); err != nil {
+	if err = os.MkdirAll(root+"/meta", 0700); err != nil {
 		return nil, err
 	}
+	labels, notBefore, policy := spec.Labels, spec.NotBefore, spec.Policy
+	j := &Job{root: root, results: make(map[string]*Result), id: id, labels: labels, notBefore: notBefore, policy: policy,
+		reqs: spec.Requirements, submitter: spec.Submitter, dataSize: int64(len(data)), progress: make([]Progress, 0)}
 
-	if err = j.setStatus(ready); err != nil {
+	if err = j.setStatus(creating); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(root+"/data", data, 0600); err != nil {
+		return nil, err
+	}
+	if len(labels) > 0 {
+		if err = ioutil.WriteFile(root+"/labels", []byte(strings.Join(labels, "\n")+"\n"), 0600); err != nil {
+			return nil, err
+		}
+	}
+	if !notBefore.IsZero() {
+		if err = ioutil.WriteFile(root+"/not_before", []byte(notBefore.UTC().Format(time.RFC3339Nano)), 0600); err != nil {
+			return nil, err
+		}
+	}
+	if !policy.isZero() {
+		cnt, _ := json.Marshal(policy)
+		if err = ioutil.WriteFile(root+"/policy", cnt, 0600); err != nil {
+			return nil, err
+		}
+	}
+	if !spec.Requirements.isZero() {
+		cnt, _ := json.Marshal(spec.Requirements)
+		if err = ioutil.WriteFile(root+"/requirements", cnt, 0600); err != nil {
+			return nil, err
+		}
+	}
+	if spec.Submitter != "" {
+		if err = ioutil.WriteFile(root+"/submitter", []byte(spec.Submitter), 0600); err != nil {
+			return nil, err
+		}
+	}
+	to := JobStatus(ready)
+	if notBefore.After(time.Now()) {
+		to = scheduled
+	}
+	if err = j.setStatus(to); err != nil {
 		return nil, err
 	}
 	return j, err
 }
 
-func ResumeJob(root string, id string) (*Job, error){
-	stat, _:= os.Stat(root);
-	if (!stat.IsDir()) {
+func ResumeJob(root string, id string) (*Job, error) {
+	stat, _ := os.Stat(root)
+	if !stat.IsDir() {
 		return nil, fmt.Errorf("directory '%s' does not exist\n ", root)
 	}
 
 	status, err := ioutil.ReadFile(root + "/status")
-	if (err != nil) {
+	if err != nil {
 		return nil, err
 	}
 
-	entries, err:= ioutil.ReadDir(root + "/results");
-	results := make(map[string]bool)
+	if err = os.MkdirAll(root+"/meta", 0700); err != nil {
+		return nil, err
+	}
+	results, err := readResults(root)
 	if err != nil {
 		return nil, err
 	}
-	for _, e := range entries {
-		if e.IsDir() {
-			results[e.Name()] = true
-		}
+
+	labels, err := readLabels(root)
+	if err != nil {
+		return nil, err
+	}
+
+	notBefore, err := readNotBefore(root)
+	if err != nil {
+		return nil, err
 	}
 
-	j := &Job{root, JobStatus(status[0]), results, id}
-	if err = j.setStatus(ready); err != nil {
+	policy, err := readPolicy(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var reqs Requirements
+	if err = readJSON(root+"/requirements", &reqs); err != nil {
+		return nil, err
+	}
+
+	submitter, err := ioutil.ReadFile(root + "/submitter")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	attempts, err := readAttempts(root)
+	if err != nil {
+		return nil, err
+	}
+
+	progress, err := readProgress(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var dataSize int64
+	if data, err := os.Stat(root + "/data"); err == nil {
+		dataSize = data.Size()
+	}
+
+	j := &Job{root: root, status: JobStatus(status[0]), results: results, id: id, labels: labels, notBefore: notBefore,
+		policy: policy, reqs: reqs, submitter: string(submitter), dataSize: dataSize, attempts: attempts,
+		progress: progress, logsSize: diskUsage(root + "/logs")}
+	if err = j.recoverStatus(); err != nil {
 		return nil, err
 	}
 	return j, nil
 }
 
-func (j *Job) Process() error {
-	return j.switchStatus(ready, processing)
+// recoverStatus settles the status of a job resumed from the disk. A job
+// whose processing is over, or not started, keeps its status and the
+// moment it entered it. A job that was not fully created, or was being
+// processed, is processable again: ready, or scheduled if it must not be
+// processed yet. The job must not be indexed yet.
+func (j *Job) recoverStatus() error {
+	switch j.status {
+	case scheduled, terminating, terminated, failed, expired:
+		//Scheduled jobs are promoted by the index once due
+		stat, err := os.Stat(j.root + "/status")
+		if err != nil {
+			return err
+		}
+		j.since = stat.ModTime()
+		return nil
+	}
+	to := JobStatus(ready)
+	if j.notBefore.After(time.Now()) {
+		to = scheduled
+	}
+	return j.setStatus(to)
 }
 
-func (j *Job) Terminating() error {
-	return j.switchStatus(processing, terminating)
+// readResults indexes the results of a job. Like AddResult writes them,
+// every regular file below the results directory is a result named
+// after its slash-separated relative path.
+func readResults(root string) (map[string]*Result, error) {
+	results := make(map[string]*Result)
+	base := filepath.Join(root, "results")
+	err := filepath.Walk(base, func(p string, stat os.FileInfo, err error) error {
+		if err != nil || !stat.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(base, p)
+		if err != nil {
+			return err
+		}
+		r := filepath.ToSlash(rel)
+		if results[r], err = readResultInfo(root, r); err != nil {
+			return err
+		}
+		return nil
+	})
+	return results, err
 }
 
-func (j *Job) Terminated() error {
-	return j.switchStatus(terminating, terminated)
+// readNotBefore reads the moment a delayed job becomes ready, if any.
+func readNotBefore(root string) (time.Time, error) {
+	cnt, err := ioutil.ReadFile(root + "/not_before")
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, strings.TrimSpace(string(cnt)))
 }
 
-func (j *Job) switchStatus(from, to JobStatus) error {
-	if (j.status != from) {
-		return &StatusError{from, to}
-	}
-	return j.setStatus(to)
+// readPolicy reads the limits of a job, if any.
+func readPolicy(root string) (JobPolicy, error) {
+	var p JobPolicy
+	err := readJSON(root+"/policy", &p)
+	return p, err
 }
 
-func (j *Job) setStatus(to JobStatus) error {
-	if err := ioutil.WriteFile(j.root + "/status", []byte{byte(to)}, 0600); err != nil {
+// readJSON decodes a file of a job into v. A missing file leaves v untouched.
+func readJSON(p string, v interface{}) error {
+	cnt, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
 		return err
 	}
-	j.status = to
+	if err = json.Unmarshal(cnt, v); err != nil {
+		return fmt.Errorf("%s: %s", p, err)
+	}
 	return nil
 }
 
-func (j *Job) String() string {
-	return j.Id() + j.Status().String();
+// readAttempts reads the number of times a job was processed.
+func readAttempts(root string) (int, error) {
+	cnt, err := ioutil.ReadFile(root + "/attempts")
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(cnt)))
+}
+
+// readLabels reads the labels of a job, one per line.
+func readLabels(root string) ([]string, error) {
+	cnt, err := ioutil.ReadFile(root + "/labels")
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(cnt)), nil
+}
+
+// Process starts the processing of a ready job by a worker, if named. A
+// job past its deadline expires instead.
+func (j *Job) Process(worker string, by Actor) error {
+	owned := worker != "" && j.workers != nil
+	if owned {
+		if err := j.workers.reserve(worker, j.id, j.reqs.Resources); err == errHeld {
+			//A repeated request, the reservation belongs to the processing
+			return &StatusError{ready, j.Status()}
+		} else if err != nil {
+			return err
+		}
+	}
+	err := j.locked(func() error {
+		if j.status == ready && j.pastDeadline(time.Now()) {
+			if err := j.switchLocked(ready, expired, System); err != nil {
+				return err
+			}
+			return &StatusError{ready, expired}
+		}
+		if err := j.switchLocked(ready, processing, by); err != nil {
+			return err
+		}
+		if owned {
+			j.owner = worker
+		}
+		return nil
+	})
+	if err != nil && owned {
+		j.workers.release(worker, j.id, ready)
+	}
+	return err
+}
+
+func (j *Job) Terminating(by Actor) error {
+	return j.switchStatus(processing, terminating, by)
+}
+
+func (j *Job) Terminated(by Actor) error {
+	return j.switchStatus(terminating, terminated, by)
 }
 
+// Promote makes a scheduled job ready.
+func (j *Job) Promote(by Actor) error {
+	return j.switchStatus(scheduled, ready, by)
+}
+
+// Failed declares the processing of the job went wrong.
+func (j *Job) Failed(by Actor) error {
+	return j.switchStatus(processing, failed, by)
+}
 
+// Cancel fails a job that is not finished yet, whatever its status.
+func (j *Job) Cancel(by Actor) error {
+	return j.locked(func() error {
+		s := j.status
+		if s == terminated || s == failed {
+			return &StatusError{processing, s}
+		}
+		return j.switchLocked(s, failed, by)
+	})
+}
 
+// Expire declares a job that was not processed is past its deadline.
+func (j *Job) Expire(by Actor) error {
+	return j.locked(func() error {
+		s := j.status
+		if s != ready && s != scheduled {
+			return &StatusError{ready, s}
+		}
+		return j.switchLocked(s, expired, by)
+	})
+}
 
+// TimedOut ends a processing that exceeded the timeout. The job is ready
+// again while it has retries left, failed otherwise.
+func (j *Job) TimedOut(by Actor) error {
+	return j.locked(func() error {
+		return j.switchLocked(processing, j.afterTimeout(), by)
+	})
+}
+
+// afterTimeout returns the status of a processing that exceeded the timeout.
+func (j *Job) afterTimeout() JobStatus {
+	if j.attempts <= j.policy.Retries {
+		return ready
+	}
+	return failed
+}
+
+func (j *Job) pastDeadline(now time.Time) bool {
+	return !j.policy.Deadline.IsZero() && !j.policy.Deadline.After(now)
+}
+
+func (j *Job) pastTimeout(now time.Time) bool {
+	return j.status == processing && j.policy.Timeout > 0 && !j.started.Add(j.policy.Timeout).After(now)
+}
 
+// arm registers the next moments the job must be checked at, according
+// to its status.
+func (j *Job) arm() {
+	if j.wheel == nil {
+		return
+	}
+	switch j.status {
+	case scheduled:
+		j.wheel.add(j.id, j.notBefore)
+		fallthrough
+	case ready:
+		if !j.policy.Deadline.IsZero() {
+			j.wheel.add(j.id, j.policy.Deadline)
+		}
+	case processing:
+		if j.policy.Timeout > 0 {
+			j.wheel.add(j.id, j.started.Add(j.policy.Timeout))
+		}
+	}
+}
+
+// finished indicates if the job will no longer change.
+func (j *Job) finished() bool {
+	return j.status == terminated || j.status == failed || j.status == expired
+}
+
+// locked runs fn with the job locked, and frozen if needed.
+func (j *Job) locked(fn func() error) error {
+	if j.frozen != nil {
+		j.frozen.RLock()
+		defer j.frozen.RUnlock()
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return fn()
+}
+
+func (j *Job) switchStatus(from, to JobStatus, by Actor) error {
+	return j.locked(func() error {
+		return j.switchLocked(from, to, by)
+	})
+}
+
+// switchLocked changes the status of the job. The job must be locked.
+func (j *Job) switchLocked(from, to JobStatus, by Actor) error {
+	if j.status != from {
+		return &StatusError{from, j.status}
+	}
+	since := j.since
+	if err := j.setStatus(to); err != nil {
+		return err
+	}
+	metrics.transition(j, from, to, since)
+	j.audit.record(by, j.id, from.String(), to.String())
+	if to != processing && to != terminating {
+		if j.owner != "" {
+			j.workers.release(j.owner, j.id, to)
+			j.owner = ""
+		}
+		j.endAttempt()
+	}
+	j.arm()
+	return nil
+}
+
+// setStatus writes the status of the job. The job must be locked, unless
+// it is not indexed yet.
+func (j *Job) setStatus(to JobStatus) error {
+	if to == processing {
+		if err := ioutil.WriteFile(j.root+"/attempts", []byte(strconv.Itoa(j.attempts+1)), 0600); err != nil {
+			return err
+		}
+		j.attempts++
+	}
+	if err := ioutil.WriteFile(j.root+"/status", []byte{byte(to)}, 0600); err != nil {
+		return err
+	}
+	j.status = to
+	j.since = time.Now()
+	if to == processing {
+		j.started = j.since
+	}
+	return nil
+}
+
+// sync flushes the status of the job and its directory to the disk.
+func (j *Job) sync() error {
+	if err := syncPath(j.root + "/status"); err != nil {
+		return err
+	}
+	return syncPath(j.root)
+}
+
+func syncPath(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+func (j *Job) String() string {
+	return j.Id() + j.Status().String()
+}
@@ -0,0 +1,44 @@
+/**
+ * Jobs resumed from the disk.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"testing"
+)
+
+// On a restart, only the jobs being processed are processable again.
+func TestResumeRecoversStatus(t *testing.T) {
+	root := t.TempDir()
+	idx, err := NewIndex(root, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fixtures {
+		lead(t, idx, f)
+	}
+	restarted, err := NewIndex(root, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[JobStatus]JobStatus{processing: ready}
+	for _, f := range fixtures {
+		j, ok := restarted.GetJob(f.id)
+		if !ok {
+			t.Errorf("%s: not resumed", f.id)
+			continue
+		}
+		want, ok := expected[f.to]
+		if !ok {
+			want = f.to
+		}
+		if j.Status() != want {
+			t.Errorf("%s: status '%s', expected '%s'", f.id, j.Status(), want)
+		}
+		if j.Since().IsZero() {
+			t.Errorf("%s: no moment for its status", f.id)
+		}
+	}
+}
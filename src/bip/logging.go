@@ -0,0 +1,140 @@
+/**
+ * Structured logs and identification of the requests.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Identity of the requests without any token.
+const anonymous = "anonymous"
+
+// Identity of the requests with a token that is not declared.
+const unknownToken = "unknown"
+
+type ctxKey int
+
+const actorKey ctxKey = 0
+
+var (
+	//The identities, indexed by token
+	tokens     = make(map[string]string)
+	tokensLock sync.RWMutex
+)
+
+// SetLogOutput makes the logs JSON lines written to w. Levels are
+// 'debug', 'info', 'warn' and 'error'.
+func SetLogOutput(w io.Writer, level string) {
+	var l slog.Level
+	l.UnmarshalText([]byte(level))
+	slog.SetDefault(slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: l})))
+}
+
+// setTokens declares the tokens, indexed by identity.
+func setTokens(byName map[string]string) {
+	m := make(map[string]string)
+	for name, tok := range byName {
+		m[tok] = name
+	}
+	tokensLock.Lock()
+	defer tokensLock.Unlock()
+	tokens = m
+}
+
+// identify returns the identity behind the bearer token of a request.
+func identify(r *http.Request) string {
+	auth := r.Header.Get("authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return anonymous
+	}
+	tokensLock.RLock()
+	defer tokensLock.RUnlock()
+	if who, ok := tokens[strings.TrimPrefix(auth, "Bearer ")]; ok {
+		return who
+	}
+	return unknownToken
+}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withActor attaches the request identifier and the identity of the
+// client to the request. The identifier is taken from the
+// 'X-Request-Id' header if provided.
+func withActor(w http.ResponseWriter, r *http.Request) (*http.Request, Actor) {
+	a := Actor{Who: identify(r), RequestId: r.Header.Get("x-request-id")}
+	if a.RequestId == "" {
+		a.RequestId = newRequestId()
+	}
+	w.Header().Set("x-request-id", a.RequestId)
+	return r.WithContext(context.WithValue(r.Context(), actorKey, a)), a
+}
+
+// actor returns who sent a request.
+func actor(r *http.Request) Actor {
+	if a, ok := r.Context().Value(actorKey).(Actor); ok {
+		return a
+	}
+	return Actor{Who: anonymous}
+}
+
+// logger returns a logger annotated with the request identifier.
+func logger(r *http.Request) *slog.Logger {
+	a := actor(r)
+	return slog.With("request_id", a.RequestId, "who", a.Who)
+}
+
+// clientAddr returns the address of the client, '@' for a Unix domain socket.
+func clientAddr(r *http.Request) string {
+	if r.RemoteAddr == "" || r.RemoteAddr == "@" {
+		return "@"
+	}
+	return r.RemoteAddr
+}
+
+// statusRecorder captures the status code and the size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Flush supports the streamed responses.
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
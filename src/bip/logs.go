@@ -0,0 +1,289 @@
+/**
+ * Logs of the jobs, streamed by the workers.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Size of the chunks read from a log stream.
+const logChunkSize = 32 << 10
+
+func (j *Job) logPath(attempt int) string {
+	return j.root + "/logs/" + strconv.Itoa(attempt)
+}
+
+// LogAttempts returns the processing attempts having logs, in order.
+func (j *Job) LogAttempts() []int {
+	res := make([]int, 0)
+	cnt, _ := ioutil.ReadDir(j.root + "/logs")
+	for _, e := range cnt {
+		if n, err := strconv.Atoi(e.Name()); err == nil {
+			res = append(res, n)
+		}
+	}
+	sort.Ints(res)
+	return res
+}
+
+// AttemptError reports logs sent to a processing attempt that is over.
+type AttemptError struct {
+	Attempt int
+	//The current attempt of the job, and its status
+	Current int
+	Status  JobStatus
+}
+
+func (err *AttemptError) Error() string {
+	if err.Current != err.Attempt {
+		return fmt.Sprintf("Attempt %d is over, the job is at attempt %d", err.Attempt, err.Current)
+	}
+	return fmt.Sprintf("Attempt %d is over, the job is '%s'", err.Attempt, err.Status)
+}
+
+// logging indicates if logs may still be appended to an attempt. The job
+// must be locked.
+func (j *Job) logging(attempt int) bool {
+	return (j.status == processing || j.status == terminating) && j.attempts == attempt
+}
+
+// acceptsLogs indicates if logs may still be appended to an attempt.
+func (j *Job) acceptsLogs(attempt int) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.logging(attempt)
+}
+
+// attemptOver returns a channel closed once an attempt is over.
+func (j *Job) attemptOver(attempt int) <-chan struct{} {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if !j.logging(attempt) {
+		over := make(chan struct{})
+		close(over)
+		return over
+	}
+	if j.attemptEnd == nil {
+		j.attemptEnd = make(chan struct{})
+	}
+	return j.attemptEnd
+}
+
+// endAttempt signals the current attempt is over. The job must be locked.
+func (j *Job) endAttempt() {
+	if j.attemptEnd != nil {
+		close(j.attemptEnd)
+		j.attemptEnd = nil
+	}
+}
+
+// logsChanged returns a channel closed once logs are appended.
+func (j *Job) logsChanged() <-chan struct{} {
+	j.logLock.Lock()
+	defer j.logLock.Unlock()
+	if j.logSignal == nil {
+		j.logSignal = make(chan struct{})
+	}
+	return j.logSignal
+}
+
+func (j *Job) notifyLogs() {
+	j.logLock.Lock()
+	defer j.logLock.Unlock()
+	if j.logSignal != nil {
+		close(j.logSignal)
+		j.logSignal = nil
+	}
+}
+
+// errStopping signals a log stream ended as bipd is shutting down.
+var errStopping = errors.New("bipd is shutting down")
+
+// AppendLog appends a stream to the logs of the current attempt, chunk
+// by chunk, until the stream ends, the attempt is over or bipd shuts
+// down. The job must be processed. It returns the attempt and the number
+// of bytes appended.
+func (j *Job) AppendLog(in io.Reader) (int, int64, error) {
+	var attempt int
+	err := j.locked(func() error {
+		if j.status != processing && j.status != terminating {
+			return &StatusError{processing, j.status}
+		}
+		attempt = j.attempts
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := os.MkdirAll(j.root+"/logs", 0700); err != nil {
+		return attempt, 0, err
+	}
+	f, err := os.OpenFile(j.logPath(attempt), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return attempt, 0, err
+	}
+	defer f.Close()
+	//The stream is read aside, so an idle stream does not outlive its attempt
+	type chunk struct {
+		b   []byte
+		err error
+	}
+	chunks, done := make(chan chunk), make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			buf := make([]byte, logChunkSize)
+			n, err := in.Read(buf)
+			select {
+			case chunks <- chunk{buf[:n], err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	over := j.attemptOver(attempt)
+	var total int64
+	for {
+		select {
+		case c := <-chunks:
+			if len(c.b) > 0 {
+				if err := j.appendChunk(f, attempt, c.b); err != nil {
+					return attempt, total, err
+				}
+				total += int64(len(c.b))
+			}
+			if c.err == io.EOF {
+				return attempt, total, nil
+			} else if c.err != nil {
+				return attempt, total, c.err
+			}
+		case <-over:
+			j.lock.Lock()
+			err := &AttemptError{attempt, j.attempts, j.status}
+			j.lock.Unlock()
+			return attempt, total, err
+		case <-stopping:
+			return attempt, total, errStopping
+		}
+	}
+}
+
+// appendChunk writes a chunk of logs to an attempt, unless it is over.
+// The job is only locked meanwhile, so a stream does not hold a snapshot.
+func (j *Job) appendChunk(f *os.File, attempt int, b []byte) error {
+	err := j.locked(func() error {
+		if !j.logging(attempt) {
+			return &AttemptError{attempt, j.attempts, j.status}
+		}
+		size := int64(len(b))
+		if err := j.quotas.reserve(j, size); err != nil {
+			return err
+		}
+		if _, err := f.Write(b); err != nil {
+			j.quotas.release(j, size)
+			return err
+		}
+		j.logLock.Lock()
+		j.logsSize += size
+		j.logLock.Unlock()
+		return nil
+	})
+	if err == nil {
+		j.notifyLogs()
+	}
+	return err
+}
+
+// PostLogs appends the request body to the logs of a job being processed.
+// The body is usually streamed, with a chunked encoding.
+func PostLogs(w http.ResponseWriter, r *http.Request, j *Job) {
+	//A log stream may pause for long
+	if b, ok := r.Body.(*slowBodyReader); ok {
+		r.Body = b.ReadCloser
+	}
+	attempt, n, err := j.AppendLog(r.Body)
+	if err != nil {
+		//The client may still be streaming. The body is no longer read,
+		//rather than drained before the connection is released
+		http.NewResponseController(w).SetReadDeadline(time.Now())
+	}
+	if err == errStopping {
+		writeError(w, http.StatusServiceUnavailable, &APIError{Code: CodeUnavailable, Message: "bipd is shutting down", Job: j.Id()})
+		return
+	} else if err != nil {
+		reportError(w, err, j.Id(), "Error while appending the logs")
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"attempt": int64(attempt), "bytes": n})
+}
+
+// GetLogs streams the logs of an attempt, the last one by default. With
+// 'follow', the logs are streamed as they are appended, until the
+// attempt is over.
+func GetLogs(w http.ResponseWriter, r *http.Request, j *Job) {
+	r.ParseForm()
+	follow := r.Form.Get("follow") == "true"
+	attempt := j.Attempts()
+	if s := r.Form.Get("attempt"); s != "" {
+		var err error
+		if attempt, err = strconv.Atoi(s); err != nil || attempt < 0 || attempt > j.Attempts() {
+			badRequest(w, CodeInvalidParameter, "Invalid parameter 'attempt': expected an attempt between 0 and "+strconv.Itoa(j.Attempts())+", got '"+s+"'")
+			return
+		}
+	} else if all := j.LogAttempts(); !j.acceptsLogs(attempt) && len(all) > 0 {
+		attempt = all[len(all)-1]
+	}
+	w.Header().Set("content-type", "text/plain; charset=utf-8")
+	w.Header().Set("x-bip-attempt", strconv.Itoa(attempt))
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	for {
+		//Taken first, so no append is missed
+		changed := j.logsChanged()
+		live := follow && j.acceptsLogs(attempt) && !isShuttingDown()
+		if f == nil {
+			f, _ = os.Open(j.logPath(attempt))
+		}
+		if f != nil {
+			if _, err := io.Copy(w, f); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if !live {
+			return
+		}
+		//The status of the job is checked every second
+		select {
+		case <-changed:
+		case <-time.After(time.Second):
+		case <-stopping:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,112 @@
+/**
+ * Logs streamed by the workers.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// A log stream must end once its attempt is over, and what follows must
+// neither be stored nor accounted.
+func TestLogStreamEndsWithAttempt(t *testing.T) {
+	for _, x := range []struct {
+		name string
+		end  func(j *Job) error
+		want AttemptError
+	}{
+		{"failed", func(j *Job) error { return j.Failed(System) }, AttemptError{1, 1, failed}},
+		{"retried", func(j *Job) error {
+			if err := j.TimedOut(System); err != nil {
+				return err
+			}
+			return j.Process("", System)
+		}, AttemptError{1, 2, processing}},
+	} {
+		t.Run(x.name, func(t *testing.T) {
+			idx, err := NewIndex(t.TempDir(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			j := lead(t, idx, fixture{"j", JobSpec{Policy: JobPolicy{Retries: 1}}, processing, nil})
+			in, feed := io.Pipe()
+			defer in.Close()
+			res := make(chan error, 1)
+			go func() {
+				_, _, err := j.AppendLog(in)
+				res <- err
+			}()
+			appended := j.logsChanged()
+			fmt.Fprintln(feed, "before")
+			<-appended
+			size := j.size()
+			if err = x.end(j); err != nil {
+				t.Fatal(err)
+			}
+			go fmt.Fprintln(feed, "after")
+			err = <-res
+			if e, ok := err.(*AttemptError); !ok || *e != x.want {
+				t.Fatalf("got '%v', expected '%v'", err, &x.want)
+			}
+			cnt, _ := ioutil.ReadFile(j.logPath(1))
+			if string(cnt) != "before\n" {
+				t.Errorf("logs '%s', expected 'before\\n'", cnt)
+			}
+			if j.size() != size {
+				t.Errorf("size %d, expected %d", j.size(), size)
+			}
+		})
+	}
+}
+
+// An idle log stream must end once its attempt is over, or once bipd
+// shuts down, without waiting for more logs.
+func TestIdleLogStreamEnds(t *testing.T) {
+	for _, x := range []struct {
+		name string
+		end  func(j *Job)
+		want func(err error) bool
+	}{
+		{"attempt over", func(j *Job) { j.Failed(System) }, func(err error) bool {
+			_, ok := err.(*AttemptError)
+			return ok
+		}},
+		{"shutdown", func(j *Job) { close(stopping) }, func(err error) bool { return err == errStopping }},
+	} {
+		t.Run(x.name, func(t *testing.T) {
+			defer func(c chan struct{}) { stopping = c }(stopping)
+			stopping = make(chan struct{})
+			idx, err := NewIndex(t.TempDir(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			j := lead(t, idx, fixture{"j", JobSpec{}, processing, nil})
+			in, feed := io.Pipe()
+			defer feed.Close()
+			res := make(chan error, 1)
+			go func() {
+				_, _, err := j.AppendLog(in)
+				res <- err
+			}()
+			//The stream is open once a first line is appended
+			appended := j.logsChanged()
+			fmt.Fprintln(feed, "before")
+			<-appended
+			x.end(j)
+			select {
+			case err = <-res:
+				if !x.want(err) {
+					t.Errorf("unexpected error '%v'", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the stream is still open")
+			}
+		})
+	}
+}
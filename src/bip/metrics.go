@@ -0,0 +1,363 @@
+/**
+ * Metrics about the jobs and the REST API, in the Prometheus text format.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the histogram buckets, in seconds.
+var (
+	durationBuckets = []float64{1, 10, 60, 300, 900, 3600, 4 * 3600, 12 * 3600, 24 * 3600, 7 * 24 * 3600}
+	latencyBuckets  = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+)
+
+// counter is a monotonic value for each set of labels.
+type counter struct {
+	name   string
+	help   string
+	values map[string]float64
+}
+
+func newCounter(name, help string) *counter {
+	return &counter{name, help, make(map[string]float64)}
+}
+
+func (c *counter) add(labels string, v float64) {
+	c.values[labels] += v
+}
+
+func (c *counter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if len(c.values) == 0 {
+		c.values[""] = 0
+	}
+	for _, l := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %v\n", c.name, braces(l), c.values[l])
+	}
+}
+
+// histogram counts observations in buckets, for each set of labels.
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	counts  map[string][]uint64
+	sums    map[string]float64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{name, help, buckets, make(map[string][]uint64), make(map[string]float64)}
+}
+
+func (h *histogram) observe(labels string, v float64) {
+	c, ok := h.counts[labels]
+	if !ok {
+		//One more bucket for +Inf
+		c = make([]uint64, len(h.buckets)+1)
+		h.counts[labels] = c
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			c[i]++
+		}
+	}
+	c[len(h.buckets)]++
+	h.sums[labels] += v
+}
+
+func (h *histogram) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	if len(h.counts) == 0 {
+		h.counts[""] = make([]uint64, len(h.buckets)+1)
+		h.sums[""] = 0
+	}
+	for _, l := range sortedKeys(h.sums) {
+		sep := ""
+		if l != "" {
+			sep = ","
+		}
+		c := h.counts[l]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s%sle=\"%v\"} %d\n", h.name, l, sep, b, c[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", h.name, l, sep, c[len(h.buckets)])
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.name, braces(l), h.sums[l])
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, braces(l), c[len(h.buckets)])
+	}
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// label formats a label pair, escaping the value.
+func label(k, v string) string {
+	v = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+	return k + `="` + v + `"`
+}
+
+// Metrics gathers the counters of bipd.
+type Metrics struct {
+	lock        sync.Mutex
+	pushes      *counter
+	pops        *counter
+	transitions *counter
+	results     *counter
+	bytes       *counter
+	queueWait   *histogram
+	processing  *histogram
+	requests    *histogram
+	gcJobs      *counter
+	gcBytes     *counter
+	archives    *counter
+	restores    *counter
+	timeouts    *counter
+	throttles   *counter
+}
+
+func newMetrics() *Metrics {
+	m := &Metrics{
+		queueWait:  newHistogram("bip_queue_wait_seconds", "Time spent by the jobs in the ready status before being processed.", durationBuckets),
+		processing: newHistogram("bip_processing_seconds", "Time between the beginning of a job processing and its termination.", durationBuckets),
+		requests:   newHistogram("bip_http_request_duration_seconds", "Latency of the HTTP requests, per route.", latencyBuckets),
+		gcJobs:     newCounter("bip_gc_jobs_deleted_total", "Number of finished jobs deleted by the garbage collector."),
+		gcBytes:    newCounter("bip_gc_reclaimed_bytes_total", "Number of bytes reclaimed by the garbage collector."),
+		timeouts:   newCounter("bip_jobs_timed_out_total", "Number of processings that exceeded their timeout."),
+		throttles:  newCounter("bip_http_throttled_total", "Number of requests and connections refused for exceeding a limit."),
+	}
+	m.resetSeeded()
+	return m
+}
+
+// resetSeeded restarts from zero the counters seeded from an index.
+func (m *Metrics) resetSeeded() {
+	m.pushes = newCounter("bip_jobs_pushed_total", "Number of submitted jobs.")
+	m.pops = newCounter("bip_jobs_popped_total", "Number of jobs handed out to be processed.")
+	m.transitions = newCounter("bip_status_transitions_total", "Number of status transitions.")
+	m.results = newCounter("bip_results_added_total", "Number of stored results.")
+	m.bytes = newCounter("bip_result_bytes_stored_total", "Number of bytes of stored results.")
+	m.archives = newCounter("bip_jobs_archived_total", "Number of jobs moved to the archive.")
+	m.restores = newCounter("bip_jobs_restored_total", "Number of jobs restored from the archive.")
+}
+
+var metrics = newMetrics()
+
+// seed initializes the counters from the state of an index, so they
+// stay consistent after a restart: the submissions and the results from
+// the jobs, the processings from their attempts, the transitions, the
+// archivals and the restorations from the audit log. The other metrics
+// restart from zero. The seeded counters are reset first, so loading
+// another index replaces them rather than adding to them.
+func (m *Metrics) seed(idx *Index) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.resetSeeded()
+	for _, j := range idx.jobs {
+		m.pushes.add("", 1)
+		m.pops.add("", float64(j.Attempts()))
+		for _, r := range j.Results() {
+			info, _ := j.ResultInfo(r)
+			m.results.add("", 1)
+			m.bytes.add("", float64(info.Size))
+		}
+	}
+	err := idx.audit.scan(func(e AuditEntry) {
+		switch {
+		case e.To == "archived":
+			m.archives.add("", 1)
+		case e.From == "archived":
+			m.restores.add("", 1)
+		case isStatus(e.From) && isStatus(e.To):
+			m.transitions.add(label("from", e.From)+","+label("to", e.To), 1)
+		}
+	})
+	if err != nil {
+		slog.Warn("unable to seed the metrics from the audit log", "error", err)
+	}
+}
+
+// isStatus tells if a name from the audit log is a job status.
+func isStatus(name string) bool {
+	for s := JobStatus(ready); s <= expired; s++ {
+		if s.String() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Metrics) pushed() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.pushes.add("", 1)
+}
+
+func (m *Metrics) resultAdded(size int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.results.add("", 1)
+	m.bytes.add("", float64(size))
+}
+
+// transition records a status transition. since is the moment the job
+// entered the status it is leaving.
+func (m *Metrics) transition(j *Job, from, to JobStatus, since time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.transitions.add(label("from", from.String())+","+label("to", to.String()), 1)
+	if to == processing {
+		m.pops.add("", 1)
+	}
+	if from == ready && to == processing && !since.IsZero() {
+		m.queueWait.observe("", j.since.Sub(since).Seconds())
+	} else if to == terminated && !j.started.IsZero() {
+		m.processing.observe("", j.since.Sub(j.started).Seconds())
+	}
+}
+
+// collected records the jobs deleted by the garbage collector.
+func (m *Metrics) collected(jobs int, size int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.gcJobs.add("", float64(jobs))
+	m.gcBytes.add("", float64(size))
+}
+
+func (m *Metrics) archived() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.archives.add("", 1)
+}
+
+func (m *Metrics) restored() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.restores.add("", 1)
+}
+
+func (m *Metrics) timedOut() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.timeouts.add("", 1)
+}
+
+// throttled records a request, or a connection, was refused. reason is
+// 'ip', 'token' or 'connections'.
+func (m *Metrics) throttled(reason string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.throttles.add(label("reason", reason), 1)
+}
+
+func (m *Metrics) request(route, method string, d time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.requests.observe(label("route", route)+","+label("method", method), d.Seconds())
+}
+
+// Number of requests being served, and served.
+var inFlight, served int64
+
+// Requests returns the number of requests being served, and served.
+func Requests() (int64, int64) {
+	return atomic.LoadInt64(&inFlight), atomic.LoadInt64(&served)
+}
+
+// instrument identifies the requests, measures the latency of a handler
+// and writes the access log. A panicking handler is accounted as an
+// internal error before the panic goes on.
+func instrument(route, method string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&inFlight, 1)
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		r, a := withActor(rec, r)
+		defer func() {
+			p := recover()
+			d := time.Since(start)
+			metrics.request(route, method, d)
+			atomic.AddInt64(&inFlight, -1)
+			atomic.AddInt64(&served, 1)
+			if rec.status == 0 && p != nil {
+				rec.status = http.StatusInternalServerError
+			} else if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			slog.Info("request", "request_id", a.RequestId, "client", clientAddr(r), "who", a.Who,
+				"method", method, "route", route, "path", r.URL.Path, "status", rec.status,
+				"bytes", rec.bytes, "latency_ms", float64(d.Microseconds())/1000)
+			if p != nil {
+				panic(p)
+			}
+		}()
+		fn(rec, r)
+	}
+}
+
+// Write writes the metrics in the Prometheus text format. The number of
+// jobs per status and of workers are computed from the index.
+func (m *Metrics) Write(w io.Writer, idx *Index) {
+	byStatus := make(map[string]float64)
+	for s := JobStatus(creating); s <= expired; s++ {
+		byStatus[label("status", s.String())] = 0
+	}
+	for s, n := range idx.CountByStatus() {
+		byStatus[label("status", s)] = float64(n)
+	}
+	fmt.Fprintf(w, "# HELP bip_jobs Number of jobs per status.\n# TYPE bip_jobs gauge\n")
+	for _, l := range sortedKeys(byStatus) {
+		fmt.Fprintf(w, "bip_jobs{%s} %v\n", l, byStatus[l])
+	}
+	fmt.Fprintf(w, "# HELP bip_workers Number of registered workers per state.\n# TYPE bip_workers gauge\n")
+	byState := idx.workers.countByState()
+	for _, st := range []string{"alive", "stale"} {
+		fmt.Fprintf(w, "bip_workers{%s} %d\n", label("state", st), byState[st])
+	}
+	fmt.Fprintf(w, "# HELP bip_http_requests_in_flight Number of requests being served.\n# TYPE bip_http_requests_in_flight gauge\n")
+	fmt.Fprintf(w, "bip_http_requests_in_flight %d\n", atomic.LoadInt64(&inFlight))
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.pushes.write(w)
+	m.pops.write(w)
+	m.transitions.write(w)
+	m.results.write(w)
+	m.bytes.write(w)
+	m.queueWait.write(w)
+	m.processing.write(w)
+	m.requests.write(w)
+	m.gcJobs.write(w)
+	m.gcBytes.write(w)
+	m.archives.write(w)
+	m.restores.write(w)
+	m.timeouts.write(w)
+	m.throttles.write(w)
+}
+
+func GetMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "text/plain; version=0.0.4")
+	metrics.Write(w, idx)
+}
@@ -0,0 +1,85 @@
+/**
+ * Counters seeded on a restart.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+// Once seeded, the counters of a restarted bipd must match the ones
+// recorded before the restart.
+func TestMetricsSeededOnRestart(t *testing.T) {
+	root := t.TempDir()
+	idx, err := NewIndex(root, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fixtures {
+		lead(t, idx, f)
+	}
+	j := lead(t, idx, fixture{"retried", JobSpec{Policy: JobPolicy{Retries: 1}}, processing, nil})
+	if err = j.TimedOut(System); err != nil {
+		t.Fatal(err)
+	}
+	if err = j.Process("", System); err != nil {
+		t.Fatal(err)
+	}
+	old := lead(t, idx, fixture{"old", JobSpec{}, terminated, map[string]string{"r": "old"}})
+	if _, err = idx.Archive(old, System); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = idx.Restore("old", System); err != nil {
+		t.Fatal(err)
+	}
+	if err = idx.audit.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	//Loading the index again replaces the counters rather than adding to them
+	counters := func() map[string]map[string]float64 {
+		res := make(map[string]map[string]float64)
+		for _, c := range []*counter{metrics.pushes, metrics.pops, metrics.transitions,
+			metrics.results, metrics.bytes, metrics.archives, metrics.restores} {
+			res[c.name] = make(map[string]float64)
+			for l, v := range c.values {
+				res[c.name][l] = v
+			}
+		}
+		return res
+	}
+	live := counters()
+	if _, err = NewIndex(root, ""); err != nil {
+		t.Fatal(err)
+	}
+	for name, seeded := range counters() {
+		if !reflect.DeepEqual(seeded, live[name]) {
+			t.Errorf("%s: seeded with %v, expected %v", name, seeded, live[name])
+		}
+	}
+}
+
+// A panicking handler is still accounted for.
+func TestInstrumentPanic(t *testing.T) {
+	h := instrument("/panic", "GET", func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+	before := atomic.LoadInt64(&served)
+	func() {
+		defer func() {
+			if p := recover(); p != http.ErrAbortHandler {
+				t.Errorf("expected the panic to go on, got %v", p)
+			}
+		}()
+		h(httptest.NewRecorder(), httptest.NewRequest("GET", "/panic", nil))
+	}()
+	if in, n := Requests(); in != 0 || n != before+1 {
+		t.Errorf("expected no request in flight and one more served, got %d and %d", in, n-before)
+	}
+}
@@ -0,0 +1,102 @@
+/**
+ * OpenAPI description of the REST API.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Matches the gorilla/mux variables, with their optional pattern.
+var pathVar = regexp.MustCompile(`\{([a-zA-Z]+)(?::([^{}]*(?:\{[^{}]*\}[^{}]*)*))?\}`)
+
+// specPath converts a gorilla/mux path to an OpenAPI path.
+func specPath(p string) string {
+	return pathVar.ReplaceAllString(p, "{$1}")
+}
+
+func pathParams(p string) []map[string]interface{} {
+	params := make([]map[string]interface{}, 0)
+	for _, m := range pathVar.FindAllStringSubmatch(p, -1) {
+		schema := map[string]interface{}{"type": "string"}
+		if m[2] != "" {
+			schema["pattern"] = "^(" + m[2] + ")$"
+		}
+		params = append(params, map[string]interface{}{
+			"name": m[1], "in": "path", "required": true, "schema": schema,
+		})
+	}
+	return params
+}
+
+// OpenAPI generates the description of the API from its routes.
+func OpenAPI() map[string]interface{} {
+	paths := make(map[string]map[string]interface{})
+	for _, rt := range Routes() {
+		p := specPath(rt.Path)
+		if paths[p] == nil {
+			paths[p] = make(map[string]interface{})
+		}
+		params := pathParams(rt.Path)
+		for _, qp := range rt.Params {
+			params = append(params, map[string]interface{}{
+				"name": qp.Name, "in": "query", "required": qp.Required,
+				"description": qp.Description, "schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		responses := map[string]interface{}{
+			"default": map[string]interface{}{"$ref": "#/components/responses/Error"},
+		}
+		for code, desc := range rt.Responses {
+			responses[strconv.Itoa(code)] = map[string]interface{}{"description": desc}
+		}
+		paths[p][strings.ToLower(rt.Method)] = map[string]interface{}{
+			"summary":    rt.Summary,
+			"parameters": params,
+			"responses":  responses,
+		}
+	}
+	errorSchema := map[string]interface{}{
+		"type":     "object",
+		"required": []string{"code", "message"},
+		"properties": map[string]interface{}{
+			"code":     map[string]interface{}{"type": "string"},
+			"message":  map[string]interface{}{"type": "string"},
+			"job":      map[string]interface{}{"type": "string"},
+			"result":   map[string]interface{}{"type": "string"},
+			"expected": map[string]interface{}{"type": "string"},
+			"actual":   map[string]interface{}{"type": "string"},
+			"archive":  map[string]interface{}{"type": "string"},
+		},
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]interface{}{"title": "bip", "version": strings.TrimPrefix(apiPrefix, "/")},
+		"servers": []map[string]interface{}{{"url": apiPrefix}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{"Error": errorSchema},
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "An error",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func GetOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(OpenAPI())
+}
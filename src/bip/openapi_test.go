@@ -0,0 +1,202 @@
+/**
+ * Contract between the routes served and the published OpenAPI description.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// The operations of the API. Adding, removing or moving a route without
+// updating this list, or the description, breaks the contract.
+var contract = []string{
+	"GET /jobs/",
+	"PUT /jobs/",
+	"POST /jobs/",
+	"GET /jobs/{j}",
+	"DELETE /jobs/{j}",
+	"GET /jobs/{j}/data",
+	"GET /jobs/{j}/history",
+	"POST /jobs/{j}/archive",
+	"PUT /jobs/{j}/progress",
+	"GET /jobs/{j}/progress",
+	"POST /jobs/{j}/logs",
+	"GET /jobs/{j}/logs",
+	"GET /jobs/{j}/status",
+	"PUT /jobs/{j}/status",
+	"GET /jobs/{j}/results/",
+	"GET /jobs/{j}/results/{r}",
+	"POST /jobs/{j}/results/",
+	"GET /jobs/{j}/results.{format}",
+	"GET /results.{format}",
+	"GET /archive/",
+	"GET /archive/{j}",
+	"POST /archive/{j}/restore",
+	"GET /workers/",
+	"POST /workers/",
+	"GET /workers/{w}",
+	"PUT /workers/{w}/heartbeat",
+	"DELETE /workers/{w}",
+	"GET /cron/",
+	"POST /cron/",
+	"GET /cron/{c}",
+	"DELETE /cron/{c}",
+	"GET /stats",
+	"GET /quotas",
+	"GET /healthz",
+	"GET /readyz",
+	"GET /metrics",
+	"POST /gc",
+	"GET /snapshot",
+	"GET /openapi.json",
+}
+
+// published fetches the description served by the router, and returns
+// its operations with their path parameters.
+func published(t *testing.T, r *mux.Router) map[string][]string {
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", apiPrefix+"/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s/openapi.json: got %d", apiPrefix, rec.Code)
+	}
+	var spec struct {
+		Paths map[string]map[string]struct {
+			Parameters []struct {
+				Name string `json:"name"`
+				In   string `json:"in"`
+			} `json:"parameters"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("GET %s/openapi.json: %s", apiPrefix, err)
+	}
+	ops := make(map[string][]string)
+	for p, methods := range spec.Paths {
+		for m, op := range methods {
+			params := make([]string, 0)
+			for _, x := range op.Parameters {
+				if x.In == "path" {
+					params = append(params, x.Name)
+				}
+			}
+			ops[strings.ToUpper(m)+" "+p] = params
+		}
+	}
+	return ops
+}
+
+// routed walks the router and returns the operations served under the
+// version prefix, and at the root.
+func routed(t *testing.T, r *mux.Router) (map[string]bool, map[string]bool) {
+	v1, root := make(map[string]bool), make(map[string]bool)
+	err := r.Walk(func(rt *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tpl, err := rt.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := rt.GetMethods()
+		if err != nil {
+			//Not an endpoint, like the version prefix
+			return nil
+		}
+		for _, m := range methods {
+			if strings.HasPrefix(tpl, apiPrefix+"/") {
+				v1[m+" "+specPath(strings.TrimPrefix(tpl, apiPrefix))] = true
+			} else {
+				root[m+" "+specPath(tpl)] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v1, root
+}
+
+// diff reports the operations expected but missing, and the unexpected ones.
+func diff(t *testing.T, what string, got map[string]bool) {
+	want := make(map[string]bool)
+	for _, op := range contract {
+		want[op] = true
+	}
+	errs := make([]string, 0)
+	for op := range want {
+		if !got[op] {
+			errs = append(errs, "missing '"+op+"'")
+		}
+	}
+	for op := range got {
+		if !want[op] {
+			errs = append(errs, "unexpected '"+op+"'")
+		}
+	}
+	sort.Strings(errs)
+	for _, e := range errs {
+		t.Errorf("%s: %s", what, e)
+	}
+}
+
+func TestRoutesMatchContract(t *testing.T) {
+	for _, admin := range []bool{false, true} {
+		v1, root := routed(t, NewRouter(admin))
+		diff(t, "served under "+apiPrefix, v1)
+		diff(t, "served at the root", root)
+	}
+}
+
+func TestSpecMatchesContract(t *testing.T) {
+	ops := published(t, NewRouter(false))
+	documented := make(map[string]bool)
+	for op := range ops {
+		documented[op] = true
+	}
+	diff(t, "documented", documented)
+}
+
+func TestSpecPathParameters(t *testing.T) {
+	for op, params := range published(t, NewRouter(false)) {
+		want := make([]string, 0)
+		for _, m := range pathVar.FindAllStringSubmatch(op, -1) {
+			want = append(want, m[1])
+		}
+		if strings.Join(params, ",") != strings.Join(want, ",") {
+			t.Errorf("'%s': path parameters %v, expected %v", op, params, want)
+		}
+	}
+}
+
+// Every operation of the contract must reach a handler: the router must
+// neither answer 404 nor 405.
+func TestContractIsRouted(t *testing.T) {
+	r := NewRouter(false)
+	vars := strings.NewReplacer("{j}", "j1", "{r}", "plots/cpu.png", "{w}", "w1", "{c}", "c1", "{format}", "tar")
+	for _, op := range contract {
+		m, p, _ := strings.Cut(op, " ")
+		for _, prefix := range []string{"", apiPrefix} {
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(m, prefix+vars.Replace(p), nil))
+			if rec.Code == http.StatusNotFound || rec.Code == http.StatusMethodNotAllowed {
+				if code, _ := decodeCode(rec); code == "" {
+					t.Errorf("%s %s: not routed, got %d", m, prefix+vars.Replace(p), rec.Code)
+				}
+			}
+		}
+	}
+}
+
+// decodeCode returns the code of an error of the API, if any.
+func decodeCode(rec *httptest.ResponseRecorder) (string, error) {
+	var e APIError
+	err := json.Unmarshal(rec.Body.Bytes(), &e)
+	return e.Code, err
+}
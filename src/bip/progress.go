@@ -0,0 +1,179 @@
+/**
+ * Progress of the jobs, reported by the workers.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Number of progress updates kept per job.
+const maxProgress = 100
+
+// Maximum length of a progress message, and of a line of the progress
+// file. Longer lines are ignored when the file is read.
+const (
+	maxProgressMessage = 4 << 10
+	maxProgressLine    = 64 << 10
+)
+
+// Progress is an update sent while a job is processed. The fields an
+// update omits keep their previous value within the same attempt.
+type Progress struct {
+	Time time.Time `json:"time"`
+	//The processing attempt the update belongs to
+	Attempt  int              `json:"attempt"`
+	Percent  float64          `json:"percent"`
+	Message  string           `json:"message,omitempty"`
+	Counters map[string]int64 `json:"counters,omitempty"`
+}
+
+// Progress returns the latest progress update of a job, if any.
+func (j *Job) Progress() (Progress, bool) {
+	j.progressLock.Lock()
+	defer j.progressLock.Unlock()
+	if len(j.progress) == 0 {
+		return Progress{}, false
+	}
+	return j.progress[len(j.progress)-1], true
+}
+
+// ProgressHistory returns the last progress updates, oldest first.
+func (j *Job) ProgressHistory() []Progress {
+	j.progressLock.Lock()
+	defer j.progressLock.Unlock()
+	return append(make([]Progress, 0, len(j.progress)), j.progress...)
+}
+
+// SetProgress records a progress update. The job must be processed.
+// percent is negative when it is unchanged.
+func (j *Job) SetProgress(percent float64, msg string, counters map[string]int64) (Progress, error) {
+	var p Progress
+	err := j.locked(func() error {
+		var err error
+		p, err = j.setProgress(percent, msg, counters)
+		return err
+	})
+	return p, err
+}
+
+func (j *Job) setProgress(percent float64, msg string, counters map[string]int64) (Progress, error) {
+	if j.status != processing && j.status != terminating {
+		return Progress{}, &StatusError{processing, j.status}
+	}
+	j.progressLock.Lock()
+	defer j.progressLock.Unlock()
+	p := Progress{Time: time.Now().UTC(), Attempt: j.attempts, Percent: percent, Message: msg, Counters: make(map[string]int64)}
+	if n := len(j.progress); n > 0 && j.progress[n-1].Attempt == p.Attempt {
+		prev := j.progress[n-1]
+		if p.Percent < 0 {
+			p.Percent = prev.Percent
+		}
+		if p.Message == "" {
+			p.Message = prev.Message
+		}
+		for k, v := range prev.Counters {
+			p.Counters[k] = v
+		}
+	}
+	if p.Percent < 0 {
+		p.Percent = 0
+	}
+	for k, v := range counters {
+		p.Counters[k] = v
+	}
+	history := append(j.progress, p)
+	if len(history) > maxProgress {
+		history = history[len(history)-maxProgress:]
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, x := range history {
+		enc.Encode(x)
+	}
+	if err := ioutil.WriteFile(j.root+"/progress", buf.Bytes(), 0600); err != nil {
+		return Progress{}, err
+	}
+	j.progress = history
+	//An update is a sign of life of the worker
+	if j.owner != "" {
+		j.workers.heartbeat(j.owner)
+	}
+	return p, nil
+}
+
+// readProgress reads the progress updates of a job, if any.
+func readProgress(root string) ([]Progress, error) {
+	res := make([]Progress, 0)
+	f, err := os.Open(root + "/progress")
+	if os.IsNotExist(err) {
+		return res, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rd := bufio.NewReader(f)
+	for {
+		l, err := rd.ReadBytes('\n')
+		var p Progress
+		//A line cut by a crash, or too long to be an update, is ignored
+		if len(l) <= maxProgressLine && json.Unmarshal(l, &p) == nil {
+			res = append(res, p)
+		}
+		if err == io.EOF {
+			return res, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// PutProgress records the progress of a job being processed.
+func PutProgress(w http.ResponseWriter, r *http.Request, j *Job) {
+	r.ParseForm()
+	percent := -1.0
+	if s := r.Form.Get("percent"); s != "" {
+		var err error
+		if percent, err = strconv.ParseFloat(s, 64); err != nil || !(percent >= 0 && percent <= 100) {
+			badRequest(w, CodeInvalidParameter, "Invalid parameter 'percent': expected a number between 0 and 100, got '"+s+"'")
+			return
+		}
+	}
+	counters, err := ParseQuantities(r.Form.Get("counters"))
+	if err != nil {
+		badRequest(w, CodeInvalidParameter, "Invalid parameter 'counters': "+err.Error())
+		return
+	}
+	msg := r.Form.Get("message")
+	if len(msg) > maxProgressMessage {
+		badRequest(w, CodeInvalidParameter, "Invalid parameter 'message': expected at most "+strconv.Itoa(maxProgressMessage)+" bytes, got "+strconv.Itoa(len(msg)))
+		return
+	}
+	if percent < 0 && msg == "" && len(counters) == 0 {
+		badRequest(w, CodeMissingParameter, "Missing parameter 'percent', 'message' or 'counters' to report the progress")
+		return
+	}
+	p, err := j.SetProgress(percent, msg, counters)
+	if err != nil {
+		reportError(w, err, j.Id(), "Error while recording the progress")
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// GetProgress lists the last progress updates of a job, oldest first.
+func GetProgress(w http.ResponseWriter, r *http.Request, j *Job) {
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(j.ProgressHistory())
+}
@@ -0,0 +1,105 @@
+/**
+ * Progress of the jobs, reported by the workers.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// A progress file with a line too long to be an update must not prevent
+// the job from being resumed.
+func TestReadProgressSkipsLongLines(t *testing.T) {
+	root := t.TempDir()
+	cnt := `{"attempt":1,"percent":10}` + "\n" +
+		`{"attempt":1,"percent":20,"message":"` + strings.Repeat("x", 70<<10) + `"}` + "\n" +
+		`{"attempt":1,"percent":30}` + "\n" +
+		`{"attempt":1,"perc`
+	if err := ioutil.WriteFile(root+"/progress", []byte(cnt), 0600); err != nil {
+		t.Fatal(err)
+	}
+	res, err := readProgress(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0].Percent != 10 || res[1].Percent != 30 {
+		t.Errorf("got %+v, expected the updates at 10%% and 30%%", res)
+	}
+}
+
+func TestPutProgressBoundsMessage(t *testing.T) {
+	idx, err := NewIndex(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = idx.NewJob("j", nil, JobSpec{}, System); err != nil {
+		t.Fatal(err)
+	}
+	j, _ := idx.GetJob("j")
+	if err = j.Process("", System); err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range []struct {
+		msg  string
+		code int
+	}{
+		{strings.Repeat("x", maxProgressMessage), http.StatusOK},
+		{strings.Repeat("x", maxProgressMessage+1), http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("PUT", "/jobs/j/progress?"+url.Values{"message": {x.msg}}.Encode(), nil)
+		PutProgress(rec, r, j)
+		if rec.Code != x.code {
+			t.Errorf("message of %d bytes: got %d, expected %d", len(x.msg), rec.Code, x.code)
+		}
+	}
+	if p, _ := j.Progress(); len(p.Message) != maxProgressMessage {
+		t.Errorf("message of %d bytes, expected %d", len(p.Message), maxProgressMessage)
+	}
+}
+
+// The percents that cannot be encoded must be refused.
+func TestPutProgressRejectsInvalidPercents(t *testing.T) {
+	idx, err := NewIndex(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = idx.NewJob("j", nil, JobSpec{}, System); err != nil {
+		t.Fatal(err)
+	}
+	j, _ := idx.GetJob("j")
+	if err = j.Process("", System); err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range []struct {
+		percent string
+		code    int
+	}{
+		{"0", http.StatusOK},
+		{"100", http.StatusOK},
+		{"-1", http.StatusBadRequest},
+		{"100.5", http.StatusBadRequest},
+		{"NaN", http.StatusBadRequest},
+		{"Inf", http.StatusBadRequest},
+		{"-Inf", http.StatusBadRequest},
+		{"abc", http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		PutProgress(rec, httptest.NewRequest("PUT", "/jobs/j/progress?percent="+url.QueryEscape(x.percent), nil), j)
+		if rec.Code != x.code {
+			t.Errorf("percent '%s': got %d, expected %d", x.percent, rec.Code, x.code)
+		}
+	}
+	rec := httptest.NewRecorder()
+	GetProgress(rec, httptest.NewRequest("GET", "/jobs/j/progress", nil), j)
+	if !strings.HasPrefix(rec.Body.String(), "[") {
+		t.Errorf("unable to list the updates: '%s'", rec.Body.String())
+	}
+}
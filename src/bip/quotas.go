@@ -0,0 +1,277 @@
+/**
+ * Quotas on the jobs stored per submitter, and per queue.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// QuotaError reports a submission or a result exceeding a quota.
+type QuotaError struct {
+	//'submitter' or 'queue'
+	Scope string
+	Name  string
+	//'jobs', 'bytes' or 'rate'
+	What  string
+	Limit int64
+	//When the submission rate should be low enough again
+	RetryAfter time.Duration
+}
+
+func (err *QuotaError) Error() string {
+	who := "Submitter '" + err.Name + "'"
+	if err.Scope == "queue" {
+		who = "Queue '" + err.Name + "'"
+	}
+	switch err.What {
+	case "jobs":
+		return fmt.Sprintf("%s reached its quota of %d jobs. Delete or archive finished jobs first", who, err.Limit)
+	case "bytes":
+		return fmt.Sprintf("%s would exceed its quota of %d bytes of data and results", who, err.Limit)
+	}
+	return fmt.Sprintf("%s exceeds its quota of %d submissions per minute. Retry in %s", who, err.Limit, err.RetryAfter)
+}
+
+// window estimates a number of events per minute, from the events of
+// the current minute and of the previous one.
+type window struct {
+	start     time.Time
+	cur, prev int
+}
+
+func (w *window) roll(now time.Time) {
+	if d := now.Sub(w.start); d >= 2*time.Minute {
+		w.start, w.cur, w.prev = now.Truncate(time.Minute), 0, 0
+	} else if d >= time.Minute {
+		w.start, w.cur, w.prev = w.start.Add(time.Minute), 0, w.cur
+	}
+}
+
+func (w *window) rate(now time.Time) float64 {
+	w.roll(now)
+	return float64(w.prev)*(1-now.Sub(w.start).Minutes()) + float64(w.cur)
+}
+
+// wait returns how long until one more event keeps the rate within max.
+func (w *window) wait(now time.Time, max int) time.Duration {
+	f := now.Sub(w.start).Minutes()
+	var d time.Duration
+	if w.cur+1 <= max {
+		//The previous minute weighs less and less
+		x := 1 - float64(max-1-w.cur)/float64(w.prev)
+		d = time.Duration((x - f) * float64(time.Minute))
+	} else {
+		//The current minute becomes the previous one
+		x := 1 - float64(max-1)/float64(w.cur)
+		d = w.start.Add(time.Minute).Sub(now) + time.Duration(x*float64(time.Minute))
+	}
+	return d.Truncate(time.Second) + time.Second
+}
+
+// usage is what a submitter, or a queue, stores.
+type usage struct {
+	jobs  int
+	bytes int64
+	rate  window
+}
+
+// check tells if one more job of the given size, or only size bytes,
+// are within the quota.
+func (u *usage) check(q Quota, scope, name string, job bool, size int64, now time.Time) error {
+	if job && q.MaxJobs > 0 && u.jobs+1 > q.MaxJobs {
+		return &QuotaError{Scope: scope, Name: name, What: "jobs", Limit: int64(q.MaxJobs)}
+	}
+	if q.maxBytes > 0 && u.bytes+size > q.maxBytes {
+		return &QuotaError{Scope: scope, Name: name, What: "bytes", Limit: q.maxBytes}
+	}
+	if job && q.MaxRate > 0 && u.rate.rate(now)+1 > float64(q.MaxRate) {
+		return &QuotaError{Scope: scope, Name: name, What: "rate", Limit: int64(q.MaxRate), RetryAfter: u.rate.wait(now, q.MaxRate)}
+	}
+	return nil
+}
+
+// ledger tracks the usage of the submitters and of the queues. It is
+// rebuilt from the jobs when bipd starts.
+type ledger struct {
+	lock       sync.Mutex
+	submitters map[string]*usage
+	queues     map[string]*usage
+}
+
+func newLedger() *ledger {
+	return &ledger{submitters: make(map[string]*usage), queues: make(map[string]*usage)}
+}
+
+func usageOf(m map[string]*usage, k string) *usage {
+	u, ok := m[k]
+	if !ok {
+		u = &usage{}
+		m[k] = u
+	}
+	return u
+}
+
+// submitterKey returns the name of the submitter of a job, if known.
+func submitterKey(s string) string {
+	if s == "" {
+		return noShare
+	}
+	return s
+}
+
+// check tells if a job, or only size bytes, are within the quotas of
+// the submitter and of the queues.
+func (l *ledger) check(submitter string, labels []string, job bool, size int64, now time.Time) error {
+	c := currentQuotas()
+	s := submitterKey(submitter)
+	q, ok := c.Submitters[s]
+	if !ok {
+		q = c.Default
+	}
+	if err := usageOf(l.submitters, s).check(q, "submitter", s, job, size, now); err != nil {
+		return err
+	}
+	for _, lbl := range labels {
+		if q, ok := c.Queues[lbl]; ok {
+			if err := usageOf(l.queues, lbl).check(q, "queue", lbl, job, size, now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// admit checks a job of the given size can be submitted.
+func (l *ledger) admit(submitter string, labels []string, size int64, now time.Time) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.check(submitter, labels, true, size, now)
+}
+
+// submitted counts a submission in the rates.
+func (l *ledger) submitted(j *Job, now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	u := usageOf(l.submitters, submitterKey(j.submitter))
+	u.rate.roll(now)
+	u.rate.cur++
+	for _, lbl := range j.labels {
+		u = usageOf(l.queues, lbl)
+		u.rate.roll(now)
+		u.rate.cur++
+	}
+}
+
+// account adds a job to the usage, or removes it with sign -1.
+func (l *ledger) account(j *Job, sign int) {
+	if l == nil {
+		return
+	}
+	size := j.size()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, u := range l.usages(j) {
+		u.jobs += sign
+		u.bytes += int64(sign) * size
+	}
+}
+
+// reserve accounts size more bytes for a job, if within the quotas.
+func (l *ledger) reserve(j *Job, size int64) error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.check(j.submitter, j.labels, false, size, time.Now()); err != nil {
+		return err
+	}
+	for _, u := range l.usages(j) {
+		u.bytes += size
+	}
+	return nil
+}
+
+// release gives back bytes reserved for a job.
+func (l *ledger) release(j *Job, size int64) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, u := range l.usages(j) {
+		u.bytes -= size
+	}
+}
+
+func (l *ledger) usages(j *Job) []*usage {
+	res := []*usage{usageOf(l.submitters, submitterKey(j.submitter))}
+	for _, lbl := range j.labels {
+		res = append(res, usageOf(l.queues, lbl))
+	}
+	return res
+}
+
+// QuotaUsage describes the usage of a submitter, or a queue, against
+// its quota. 0 means no limit.
+type QuotaUsage struct {
+	Name  string `json:"name"`
+	Jobs  int    `json:"jobs"`
+	Bytes int64  `json:"bytes"`
+	//The submissions per minute
+	Rate     float64 `json:"rate"`
+	MaxJobs  int     `json:"max_jobs"`
+	MaxBytes int64   `json:"max_bytes"`
+	MaxRate  int     `json:"max_rate"`
+}
+
+// QuotaReport describes the usage of the submitters and of the queues
+// having a quota.
+type QuotaReport struct {
+	Submitters []QuotaUsage `json:"submitters"`
+	Queues     []QuotaUsage `json:"queues"`
+}
+
+// Quotas reports the usage of the submitters and of the queues having a
+// quota, sorted by name.
+func (idx *Index) Quotas() QuotaReport {
+	c := currentQuotas()
+	l := idx.quotas
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	describe := func(name string, u *usage, q Quota) QuotaUsage {
+		return QuotaUsage{Name: name, Jobs: u.jobs, Bytes: u.bytes, Rate: u.rate.rate(now),
+			MaxJobs: q.MaxJobs, MaxBytes: q.maxBytes, MaxRate: q.MaxRate}
+	}
+	res := QuotaReport{Submitters: make([]QuotaUsage, 0), Queues: make([]QuotaUsage, 0)}
+	for s := range c.Submitters {
+		usageOf(l.submitters, s)
+	}
+	for s, u := range l.submitters {
+		q, ok := c.Submitters[s]
+		if !ok {
+			q = c.Default
+		}
+		res.Submitters = append(res.Submitters, describe(s, u, q))
+	}
+	for lbl, q := range c.Queues {
+		res.Queues = append(res.Queues, describe(lbl, usageOf(l.queues, lbl), q))
+	}
+	sort.Slice(res.Submitters, func(a, b int) bool { return res.Submitters[a].Name < res.Submitters[b].Name })
+	sort.Slice(res.Queues, func(a, b int) bool { return res.Queues[a].Name < res.Queues[b].Name })
+	return res
+}
+
+func GetQuotas(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(idx.Quotas())
+}
@@ -0,0 +1,95 @@
+/**
+ * Quotas on the jobs stored per submitter, and per queue.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"testing"
+	"time"
+)
+
+// Once the announced delay elapsed, one more submission is within the
+// rate, while it was not before.
+func TestWindowWait(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		prev, cur int
+		//Into the current minute
+		at  time.Duration
+		max int
+	}{
+		{10, 0, 0, 10},
+		{10, 5, 20 * time.Second, 10},
+		{0, 10, 30 * time.Second, 10},
+		{4, 10, 59 * time.Second, 10},
+		{20, 20, 45 * time.Second, 10},
+		{0, 1, 0, 1},
+		{3, 0, 10 * time.Second, 1},
+	} {
+		w := window{start: start, prev: tc.prev, cur: tc.cur}
+		now := start.Add(tc.at)
+		if w.rate(now)+1 <= float64(tc.max) {
+			t.Fatalf("%+v: within the rate already", tc)
+		}
+		d := w.wait(now, tc.max)
+		if d <= 0 || d > 2*time.Minute+time.Second {
+			t.Errorf("%+v: wait %s", tc, d)
+			continue
+		}
+		if r := w.rate(now.Add(d)); r+1 > float64(tc.max) {
+			t.Errorf("%+v: rate of %.2f after waiting %s, expected at most %d", tc, r, d, tc.max-1)
+		}
+	}
+}
+
+// A rate estimated over the current minute and the previous one.
+func TestWindowRate(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		at       time.Duration
+		expected float64
+	}{
+		{0, 12},
+		{30 * time.Second, 7},
+		{time.Minute, 2},
+		{90 * time.Second, 1},
+		{2 * time.Minute, 0},
+	} {
+		w := window{start: start, prev: 10, cur: 2}
+		if r := w.rate(start.Add(tc.at)); r != tc.expected {
+			t.Errorf("after %s: rate %.2f, expected %.2f", tc.at, r, tc.expected)
+		}
+	}
+}
+
+func TestUsageCheck(t *testing.T) {
+	now := time.Now()
+	u := usage{jobs: 2, bytes: 100, rate: window{start: now, cur: 5}}
+	for _, tc := range []struct {
+		quota Quota
+		job   bool
+		size  int64
+		what  string
+	}{
+		{Quota{}, true, 1 << 30, ""},
+		{Quota{MaxJobs: 3}, true, 0, ""},
+		{Quota{MaxJobs: 2}, true, 0, "jobs"},
+		{Quota{MaxJobs: 2}, false, 10, ""},
+		{Quota{maxBytes: 110}, true, 10, ""},
+		{Quota{maxBytes: 110}, false, 11, "bytes"},
+		{Quota{MaxRate: 6}, true, 0, ""},
+		{Quota{MaxRate: 5}, true, 0, "rate"},
+		{Quota{MaxRate: 5}, false, 0, ""},
+	} {
+		err := u.check(tc.quota, "submitter", "s", tc.job, tc.size, now)
+		if tc.what == "" && err != nil {
+			t.Errorf("%+v: %s", tc, err)
+		} else if e, ok := err.(*QuotaError); tc.what != "" && (!ok || e.What != tc.what) {
+			t.Errorf("%+v: got '%v', expected a quota on %s", tc, err, tc.what)
+		} else if ok && e.What == "rate" && e.RetryAfter <= 0 {
+			t.Errorf("%+v: retry after %s", tc, e.RetryAfter)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+/**
+ * Matching of the job requirements with the resources of the workers.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Requirements are the needs of a job: the quantities of resources it
+// holds while processed, like 'mem=32GB' or 'cpu=4', and the constraints
+// on the attributes of the worker, like 'version>=2.3'.
+type Requirements struct {
+	Resources   map[string]int64 `json:"resources,omitempty"`
+	Constraints []Constraint     `json:"constraints,omitempty"`
+}
+
+func (r Requirements) isZero() bool {
+	return len(r.Resources) == 0 && len(r.Constraints) == 0
+}
+
+// Offer is what a worker presents when asking for a job: the quantities
+// of resources it has, and its attributes.
+type Offer struct {
+	Resources  map[string]int64
+	Attributes map[string]string
+}
+
+// Constraint restricts the value of a worker attribute. Without operator,
+// the attribute must only exist.
+type Constraint struct {
+	Key   string
+	Op    string
+	Value string
+}
+
+// Supported operators. The longest first, for parsing.
+var constraintOps = []string{">=", "<=", "!=", "=", ">", "<"}
+
+// ParseConstraint parses a constraint like 'version>=2.3', 'os=linux' or 'gpu'.
+func ParseConstraint(s string) (Constraint, error) {
+	for _, op := range constraintOps {
+		if i := strings.Index(s, op); i > 0 {
+			return Constraint{strings.TrimSpace(s[:i]), op, strings.TrimSpace(s[i+len(op):])}, nil
+		} else if i == 0 {
+			break
+		}
+	}
+	if s = strings.TrimSpace(s); s == "" || strings.ContainsAny(s, "=<>! ") {
+		return Constraint{}, fmt.Errorf("Invalid constraint '%s'", s)
+	}
+	return Constraint{Key: s}, nil
+}
+
+func (c Constraint) String() string {
+	return c.Key + c.Op + c.Value
+}
+
+func (c Constraint) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *Constraint) UnmarshalText(b []byte) error {
+	x, err := ParseConstraint(string(b))
+	*c = x
+	return err
+}
+
+// matches indicates if the attributes satisfy the constraint. Values made
+// of dot-separated numbers, like versions, are compared numerically.
+func (c Constraint) matches(attrs map[string]string) bool {
+	v, ok := attrs[c.Key]
+	if c.Op == "" {
+		return ok
+	} else if !ok {
+		return c.Op == "!="
+	}
+	cmp := compareValues(v, c.Value)
+	switch c.Op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func compareValues(a, b string) int {
+	x, okX := parseVersion(a)
+	y, okY := parseVersion(b)
+	if !okX || !okY {
+		return strings.Compare(a, b)
+	}
+	for i := 0; i < len(x) || i < len(y); i++ {
+		var p, q int
+		if i < len(x) {
+			p = x[i]
+		}
+		if i < len(y) {
+			q = y[i]
+		}
+		if p != q {
+			if p < q {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func parseVersion(s string) ([]int, bool) {
+	res := make([]int, 0)
+	for _, p := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, false
+		}
+		res = append(res, n)
+	}
+	return res, true
+}
+
+// ParseQuantities parses comma-separated quantities like 'mem=32GB,cpu=4'.
+// The sizes take a unit among B, KB, MB, GB and TB.
+func ParseQuantities(s string) (map[string]int64, error) {
+	res := make(map[string]int64)
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		x := strings.SplitN(kv, "=", 2)
+		if len(x) != 2 || strings.TrimSpace(x[0]) == "" {
+			return nil, fmt.Errorf("Invalid quantity '%s': expected 'name=value'", kv)
+		}
+		n, err := parseSize(x[0], x[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid quantity '%s': expected a number, possibly with a unit like 'GB'", kv)
+		}
+		res[strings.TrimSpace(x[0])] = n
+	}
+	return res, nil
+}
+
+// FormatQuantities formats quantities as parsed by ParseQuantities.
+func FormatQuantities(q map[string]int64) string {
+	res := make([]string, 0, len(q))
+	for k, v := range q {
+		res = append(res, k+"="+strconv.FormatInt(v, 10))
+	}
+	sort.Strings(res)
+	return strings.Join(res, ",")
+}
+
+// ParseConstraints parses comma-separated constraints.
+func ParseConstraints(s string) ([]Constraint, error) {
+	res := make([]Constraint, 0)
+	for _, x := range strings.Split(s, ",") {
+		if x = strings.TrimSpace(x); x == "" {
+			continue
+		}
+		c, err := ParseConstraint(x)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, c)
+	}
+	return res, nil
+}
+
+// ParseAttributes parses comma-separated attributes like 'version=2.4,gpu'.
+// An attribute without value only exists.
+func ParseAttributes(s string) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		x := strings.SplitN(kv, "=", 2)
+		if strings.TrimSpace(x[0]) == "" {
+			return nil, fmt.Errorf("Invalid attribute '%s'", kv)
+		}
+		v := ""
+		if len(x) == 2 {
+			v = strings.TrimSpace(x[1])
+		}
+		res[strings.TrimSpace(x[0])] = v
+	}
+	return res, nil
+}
+
+// fits indicates if a job can run with the offer, while held resources
+// are already in use. A resource the offer does not mention is missing.
+func (r Requirements) fits(o Offer, held map[string]int64) bool {
+	for _, c := range r.Constraints {
+		if !c.matches(o.Attributes) {
+			return false
+		}
+	}
+	for k, n := range r.Resources {
+		if avail, ok := o.Resources[k]; !ok || held[k]+n > avail {
+			return false
+		}
+	}
+	return true
+}
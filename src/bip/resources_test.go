@@ -0,0 +1,98 @@
+/**
+ * Matching of the job requirements with the resources of the workers.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQuantities(t *testing.T) {
+	for _, tc := range []struct {
+		in       string
+		expected map[string]int64
+	}{
+		{"", map[string]int64{}},
+		{"cpu=4", map[string]int64{"cpu": 4}},
+		{" mem = 2KB , cpu=1,", map[string]int64{"mem": 2 << 10, "cpu": 1}},
+		{"disk=1TB", map[string]int64{"disk": 1 << 40}},
+		{"cpu", nil},
+		{"=4", nil},
+		{"cpu=four", nil},
+	} {
+		q, err := ParseQuantities(tc.in)
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("'%s': parsed as %v, expected an error", tc.in, q)
+			}
+		} else if err != nil || !reflect.DeepEqual(q, tc.expected) {
+			t.Errorf("'%s': got %v (%v), expected %v", tc.in, q, err, tc.expected)
+		}
+	}
+}
+
+func TestParseConstraint(t *testing.T) {
+	for _, tc := range []struct {
+		in       string
+		expected Constraint
+		ok       bool
+	}{
+		{"gpu", Constraint{Key: "gpu"}, true},
+		{"version>=2.3", Constraint{"version", ">=", "2.3"}, true},
+		{"os = linux", Constraint{"os", "=", "linux"}, true},
+		{"arch!=arm", Constraint{"arch", "!=", "arm"}, true},
+		{">=2", Constraint{}, false},
+		{"", Constraint{}, false},
+		{"a b", Constraint{}, false},
+	} {
+		c, err := ParseConstraint(tc.in)
+		if (err == nil) != tc.ok || c != tc.expected {
+			t.Errorf("'%s': got %+v (%v), expected %+v", tc.in, c, err, tc.expected)
+		}
+	}
+}
+
+// The constraints are matched against the attributes, and the resources
+// against what the offer has left once the held ones are deduced.
+func TestRequirementsFit(t *testing.T) {
+	o := Offer{
+		Resources:  map[string]int64{"cpu": 4, "mem": 8 << 30},
+		Attributes: map[string]string{"version": "2.10", "os": "linux", "gpu": ""},
+	}
+	for _, tc := range []struct {
+		resources   string
+		constraints string
+		held        map[string]int64
+		fits        bool
+	}{
+		{"", "", nil, true},
+		{"cpu=4", "", nil, true},
+		{"cpu=4", "", map[string]int64{"cpu": 1}, false},
+		{"cpu=2,mem=8GB", "", map[string]int64{"cpu": 2}, true},
+		{"disk=1", "", nil, false},
+		{"", "version>=2.9", nil, true},
+		{"", "version>2.10", nil, false},
+		{"", "version<2.9.1", nil, false},
+		{"", "os=linux,gpu", nil, true},
+		{"", "os!=linux", nil, false},
+		{"", "tpu", nil, false},
+		{"", "tpu!=1", nil, true},
+		{"cpu=1", "gpu", nil, true},
+	} {
+		q, err := ParseQuantities(tc.resources)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs, err := ParseConstraints(tc.constraints)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := Requirements{Resources: q, Constraints: cs}
+		if r.fits(o, tc.held) != tc.fits {
+			t.Errorf("'%s' '%s' holding %v: fits is %v, expected %v", tc.resources, tc.constraints, tc.held, !tc.fits, tc.fits)
+		}
+	}
+}
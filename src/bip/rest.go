@@ -6,37 +6,285 @@
 package bip
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/gorilla/mux"
+	"mime"
+	"net"
 	"net/http"
-	"encoding/json"
-	"io/ioutil"
-	"log"
-	"os"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-var idx Index
+// Prefix of the headers used to carry the metadata of a result.
+const metaHeader = "X-Bip-Meta-"
+
+// Prefix of the current version of the API. The routes are also served
+// without any prefix to stay compatible with the former clients.
+const apiPrefix = "/v1"
+
+// The index, available once SetIndex is called
+var idx *Index
+
+// Route is an endpoint of the API along with its documentation.
+type Route struct {
+	Method string
+	//The path, with the gorilla/mux variables
+	Path    string
+	Handler http.HandlerFunc
+	Summary string
+	Params  []Param
+	//The success responses, indexed by status code
+	Responses map[int]string
+}
+
+// Param is a query parameter of a route.
+type Param struct {
+	Name        string
+	Description string
+	Required    bool
+}
+
+// Routes returns the endpoints of the API.
+func Routes() []Route {
+	return []Route{
+		{"GET", "/jobs/", GetJobs, "List the jobs", nil,
+			map[int]string{200: "The jobs"}},
+		{"PUT", "/jobs/", PopJob, "Process the first ready job",
+			[]Param{{"worker", "The registered worker processing the job", false},
+				{"resources", "The resources of the worker, like 'mem=64GB,cpu=16'. Only the jobs that fit are handed out", false},
+				{"attributes", "The attributes of the worker, like 'version=2.4,gpu', checked against the job constraints", false}},
+			map[int]string{302: "The job to process", 204: "No jobs are waiting for being processed"}},
+		{"POST", "/jobs/", PushJob, "Submit a job. The body is the job data",
+			[]Param{{"j", "The job identifier", true}, {"l", "Comma-separated labels", false},
+				{"not_before", "Keep the job scheduled until this RFC 3339 date, or for this delay like '2h'", false},
+				{"deadline", "Expire the job if not processed by this RFC 3339 date, or after this delay", false},
+				{"timeout", "The maximum processing duration, like '30m'", false},
+				{"retries", "How many times the job is made ready again after a timeout, before failing", false},
+				{"resources", "The resources the job holds while processed, like 'mem=32GB,cpu=4'", false},
+				{"constraints", "The constraints on the worker attributes, like 'version>=2.3,gpu'", false},
+				{"submitter", "The submitter to attribute the job to, like on an import. Ignored for the clients identified by their token", false}},
+			map[int]string{201: "The job is created"}},
+		{"GET", "/jobs/{j}", makeJobHandler(GetJob), "Get a job summary",
+			[]Param{{"details", "Describe the results rather than giving their URL", false}},
+			map[int]string{200: "The job"}},
+		{"DELETE", "/jobs/{j}", makeJobHandler(DeleteJob), "Delete a job and its results", nil,
+			map[int]string{200: "The job is deleted"}},
+		{"GET", "/jobs/{j}/data", makeJobHandler(GetData), "Get the job data", nil,
+			map[int]string{200: "The job data"}},
+		{"GET", "/jobs/{j}/history", makeJobHandler(GetHistory), "Get the state changes of a job", nil,
+			map[int]string{200: "The state changes, oldest first"}},
+		{"POST", "/jobs/{j}/archive", makeJobHandler(ArchiveJob), "Move a terminated, failed or expired job to the archive", nil,
+			map[int]string{200: "The job is archived"}},
+		{"PUT", "/jobs/{j}/progress", makeJobHandler(PutProgress), "Report the progress of a job being processed",
+			[]Param{{"percent", "The completion, between 0 and 100", false}, {"message", "A free-form message", false},
+				{"counters", "Comma-separated counters, like 'files=12,bytes=3MB'", false}},
+			map[int]string{200: "The progress, completed with the previous update"}},
+		{"GET", "/jobs/{j}/progress", makeJobHandler(GetProgress), "Get the last progress updates of a job, oldest first", nil,
+			map[int]string{200: "The progress updates"}},
+		{"POST", "/jobs/{j}/logs", makeJobHandler(PostLogs), "Append the body, possibly streamed, to the logs of the current attempt of a job being processed", nil,
+			map[int]string{200: "The attempt and the number of bytes appended"}},
+		{"GET", "/jobs/{j}/logs", makeJobHandler(GetLogs), "Get the logs of an attempt of a job",
+			[]Param{{"attempt", "The processing attempt. Default is the last one having logs", false},
+				{"follow", "'true' to stream the logs as they are appended, until the attempt is over", false}},
+			map[int]string{200: "The logs"}},
+		{"GET", "/jobs/{j}/status", makeJobHandler(GetStatus), "Get the job status", nil,
+			map[int]string{200: "The job status"}},
+		{"PUT", "/jobs/{j}/status", makeJobHandler(UpdateStatus), "Update the job status",
+			[]Param{{"s", "The new status: 'processing', 'terminating', 'terminated' or 'failed'", true},
+				{"worker", "The registered worker processing the job, when the status is 'processing'", false}},
+			map[int]string{200: "The status is updated"}},
+		{"GET", "/jobs/{j}/results/", makeJobHandler(GetResults), "List the job results",
+			[]Param{{"prefix", "Only list the results in this directory", false}, {"tree", "Nest the results by directory", false},
+				{"details", "Describe the results rather than giving their URL", false}},
+			map[int]string{200: "The results"}},
+		{"GET", "/jobs/{j}/results/{r:.+}", makeJobHandler(GetResult), "Get a job result", nil,
+			map[int]string{200: "The result, with its content type"}},
+		{"POST", "/jobs/{j}/results/", makeJobHandler(PutResult), "Store a job result. The body is the result",
+			[]Param{{"r", "The result identifier", true}, {"f", "The filename to suggest on downloads", false}},
+			map[int]string{201: "The result is stored"}},
+		{"GET", "/jobs/{j}/results.{format:tar|tar\\.gz|zip}", makeJobHandler(GetResultsArchive), "Get an archive of the job results",
+			[]Param{{"gzip", "Compress a tar archive", false}},
+			map[int]string{200: "The archive"}},
+		{"GET", "/results.{format:tar|tar\\.gz|zip}", GetJobsResultsArchive, "Get an archive of the results of several jobs",
+			[]Param{{"s", "The status of the jobs", false}, {"l", "The label of the jobs", false}, {"gzip", "Compress a tar archive", false}},
+			map[int]string{200: "The archive"}},
+		{"GET", "/archive/", GetArchivedJobs, "List the archived jobs",
+			[]Param{{"s", "The status of the jobs", false}, {"l", "The label of the jobs", false}},
+			map[int]string{200: "The archived jobs"}},
+		{"GET", "/archive/{j}", GetArchivedJob, "Get an archived job", nil,
+			map[int]string{200: "The archived job"}},
+		{"POST", "/archive/{j}/restore", RestoreJob, "Restore an archived job", nil,
+			map[int]string{200: "The restored job"}},
+		{"GET", "/workers/", GetWorkers, "List the workers, with the jobs they are processing", nil,
+			map[int]string{200: "The workers"}},
+		{"POST", "/workers/", RegisterWorker, "Register a worker, or update its description",
+			[]Param{{"name", "The worker name", true}, {"host", "The host of the worker", false},
+				{"l", "Comma-separated labels describing the worker capabilities", false},
+				{"max", "The maximum number of jobs processed at once. 0 means no limit", false}},
+			map[int]string{201: "The registered worker"}},
+		{"GET", "/workers/{w}", GetWorker, "Get a worker", nil,
+			map[int]string{200: "The worker"}},
+		{"PUT", "/workers/{w}/heartbeat", Heartbeat, "Declare a worker is alive", nil,
+			map[int]string{200: "The heartbeat is recorded"}},
+		{"DELETE", "/workers/{w}", UnregisterWorker, "Unregister a worker", nil,
+			map[int]string{200: "The worker is unregistered"}},
+		{"GET", "/cron/", GetCrons, "List the recurring jobs", nil,
+			map[int]string{200: "The recurring jobs"}},
+		{"POST", "/cron/", PostCron, "Add a recurring job. The body is the template of the job data",
+			[]Param{{"name", "The name of the recurring job", true}, {"schedule", "The cron expression", true},
+				{"id", "The template of the job identifiers", false}, {"l", "Comma-separated labels of the jobs", false},
+				{"overlap", "When the previous job is not finished: 'skip' the run, 'allow' it or 'cancel' the previous job", false},
+				{"catch_up", "The runs missed while bipd was down to spawn: 'none', the 'last' one or 'all'", false}},
+			map[int]string{201: "The recurring job is added"}},
+		{"GET", "/cron/{c}", GetCron, "Get a recurring job", nil,
+			map[int]string{200: "The recurring job"}},
+		{"DELETE", "/cron/{c}", DeleteCron, "Delete a recurring job. The spawned jobs are kept", nil,
+			map[int]string{200: "The recurring job is deleted"}},
+		{"GET", "/stats", GetStats, "Get the queue depth, the running jobs and the jobs handed out per submitter, or per label", nil,
+			map[int]string{200: "The jobs per share"}},
+		{"GET", "/quotas", GetQuotas, "Get the usage of the submitters and of the queues against their quotas", nil,
+			map[int]string{200: "The usage per submitter and per queue"}},
+		{"GET", "/healthz", GetHealth, "Check bipd is alive", nil,
+			map[int]string{200: "bipd is alive"}},
+		{"GET", "/readyz", GetReadiness, "Check bipd is ready to serve requests", nil,
+			map[int]string{200: "bipd is ready", 503: "bipd is not ready, the failing checks are detailed"}},
+		{"GET", "/metrics", GetMetrics, "Get the metrics in the Prometheus text format", nil,
+			map[int]string{200: "The metrics"}},
+		{"POST", "/gc", CollectJobs, "Delete the finished jobs according to the retention rules",
+			[]Param{{"dry_run", "Only report the jobs to delete", false}},
+			map[int]string{200: "The deleted jobs"}},
+		{"GET", "/snapshot", GetSnapshot, "Get a consistent snapshot of the store, as a tar.gz archive", nil,
+			map[int]string{200: "The snapshot"}},
+		{"GET", "/openapi.json", GetOpenAPI, "Get the description of the API", nil,
+			map[int]string{200: "The OpenAPI document"}},
+	}
+}
 
-func StartREST(i Index, port int) error {
-	idx = i
+// NewRouter registers the routes both under the version prefix and at the root.
+// Unless admin is true, the administration routes are forbidden.
+func NewRouter(admin bool) *mux.Router {
 	r := mux.NewRouter()
-	r.HandleFunc("/jobs/", GetJobs).Methods("GET")
-	r.HandleFunc("/jobs/", PopJob).Methods("PUT")
-	r.HandleFunc("/jobs/", PushJob).Methods("POST")
-	r.HandleFunc("/jobs/{j}", makeJobHandler(GetJob)).Methods("GET")
-	r.HandleFunc("/jobs/{j}/data", makeJobHandler(GetData)).Methods("GET")
-	r.HandleFunc("/jobs/{j}/status", makeJobHandler(GetStatus)).Methods("GET")
-	r.HandleFunc("/jobs/{j}/status", makeJobHandler(UpdateStatus)).Methods("PUT")
-	r.HandleFunc("/jobs/{j}/results/", makeJobHandler(GetResults)).Methods("GET")
-	r.HandleFunc("/jobs/{j}/results/{r}", makeJobHandler(GetResult)).Methods("GET")
-	r.HandleFunc("/jobs/{j}/results/", makeJobHandler(PutResult)).Methods("POST")
-	http.Handle("/", r)
-	return http.ListenAndServe(":" + strconv.Itoa(port), nil)
+	v1 := r.PathPrefix(apiPrefix).Subrouter()
+	for _, rt := range Routes() {
+		fn := rt.Handler
+		if adminRoutes[rt.Path] && !admin {
+			fn = forbidden
+		} else if !withoutIndex[rt.Path] {
+			fn = throttle(requireIndex(fn))
+		}
+		fn = instrument(specPath(rt.Path), rt.Method, fn)
+		v1.HandleFunc(rt.Path, fn).Methods(rt.Method)
+		r.HandleFunc(rt.Path, fn).Methods(rt.Method)
+	}
+	return r
 }
 
-func logInternalError(w http.ResponseWriter, userMsg , serverMsg string) {
-	http.Error(w, userMsg, http.StatusInternalServerError)
-	log.Println(serverMsg)
+// The routes that are available while the index is loading
+var withoutIndex = map[string]bool{"/healthz": true, "/readyz": true, "/openapi.json": true}
+
+// The routes only served on the administration endpoints
+var adminRoutes = map[string]bool{"/metrics": true, "/gc": true, "/snapshot": true}
+
+func forbidden(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusForbidden, &APIError{Code: CodeAdminOnly, Message: "This operation is only available on the administration endpoints"})
+}
+
+var (
+	servers    []*http.Server
+	serverLock sync.Mutex
+)
+
+// StartREST serves the API on every endpoint. Until the index is provided
+// with SetIndex, only the routes that do not need it are available. It
+// returns once StopREST is called, or when an endpoint fails.
+func StartREST(endpoints []Endpoint) error {
+	public, admin := NewRouter(false), NewRouter(true)
+	listeners := make([]net.Listener, 0)
+	for _, e := range endpoints {
+		l, err := e.Listen()
+		if err != nil {
+			for _, x := range listeners {
+				x.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, limitConnections(l))
+	}
+	//The timeouts and the size of the headers only change on restart
+	t := currentThrottle()
+	errs := make(chan error, len(endpoints))
+	serverLock.Lock()
+	for i, e := range endpoints {
+		srv := &http.Server{Handler: public, ReadHeaderTimeout: t.readHeaderTimeout, IdleTimeout: t.idleTimeout,
+			MaxHeaderBytes: int(t.maxHeaderBytes)}
+		if e.Admin {
+			srv.Handler = admin
+		}
+		servers = append(servers, srv)
+		go func(l net.Listener) {
+			errs <- srv.Serve(l)
+		}(listeners[i])
+	}
+	serverLock.Unlock()
+	for range endpoints {
+		if err := <-errs; err != http.ErrServerClosed {
+			return err
+		}
+	}
+	return nil
+}
+
+// StopREST stops accepting requests and the processing of new jobs,
+// then waits for the in-flight requests to complete. Once the timeout
+// is reached, the remaining connections are closed.
+func StopREST(timeout time.Duration) error {
+	SetShuttingDown()
+	serverLock.Lock()
+	srvs := servers
+	serverLock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	errs := make(chan error, len(srvs))
+	for _, srv := range srvs {
+		go func(srv *http.Server) {
+			err := srv.Shutdown(ctx)
+			if err == context.DeadlineExceeded {
+				srv.Close()
+			}
+			errs <- err
+		}(srv)
+	}
+	var err error
+	for range srvs {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// refuseIfShuttingDown answers 503 when bipd is shutting down. It
+// returns true if the request was refused.
+func refuseIfShuttingDown(w http.ResponseWriter) bool {
+	if isShuttingDown() {
+		writeError(w, http.StatusServiceUnavailable, &APIError{Code: CodeUnavailable, Message: "bipd is shutting down"})
+		return true
+	}
+	return false
+}
+
+// baseURL returns the URL of the API, with the version prefix if the
+// request used it.
+func baseURL(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+		return "http://" + r.Host + apiPrefix
+	}
+	return "http://" + r.Host
 }
 
 func makeJobHandler(fn func(http.ResponseWriter, *http.Request, *Job)) http.HandlerFunc {
@@ -44,170 +292,471 @@ func makeJobHandler(fn func(http.ResponseWriter, *http.Request, *Job)) http.Hand
 		id := mux.Vars(r)["j"]
 		j, ok := idx.GetJob(id)
 		if !ok {
-			http.Error(w, "Job '" + id + "' not found", http.StatusNotFound)
+			if a, ok := idx.GetArchived(id); ok {
+				jobArchived(w, a)
+			} else {
+				jobNotFound(w, id)
+			}
 			return
 		}
 		fn(w, r, j)
 	}
 }
 
-func UpdateStatus(w http.ResponseWriter, r * http.Request, j *Job) {
+func UpdateStatus(w http.ResponseWriter, r *http.Request, j *Job) {
 	r.ParseForm()
 	s := r.Form.Get("s")
 	if s == "" {
-		http.Error(w, "Missing required parameter 's' to specify the new status", http.StatusBadRequest)
+		badRequest(w, CodeMissingParameter, "Missing required parameter 's' to specify the new status")
+		return
+	}
+	if s == "processing" && refuseIfShuttingDown(w) {
 		return
 	}
 	var err error
-	switch (s) {
-		case "processing": err = j.Process()
-		case "terminating": err = j.Terminating()
-		case "terminated": err = j.Terminated()
-		default:
-			http.Error(w, "non-viable status code: " + s, http.StatusBadRequest)
-			return
+	switch s {
+	case "processing":
+		err = j.Process(r.Form.Get("worker"), actor(r))
+	case "terminating":
+		err = j.Terminating(actor(r))
+	case "terminated":
+		err = j.Terminated(actor(r))
+	case "failed":
+		err = j.Failed(actor(r))
+	default:
+		badRequest(w, CodeInvalidParameter, "non-viable status code: "+s)
+		return
 	}
-	if (err != nil) {
-		if _,ok := err.(*os.PathError); ok { //Error on the fs, reported as a 500
-			logInternalError(w, "Error while updating the job status to '" + s + "'",
-							 "Unable to update the status of job '" + j.Id() + "': " + err.Error())
-		} else { //Error at the job level, this means the status is not viable
-			http.Error(w, err.Error(), http.StatusConflict)
-		}
+	if err != nil {
+		reportError(w, err, j.Id(), "Error while updating the status of job '"+j.Id()+"' to '"+s+"'")
+		return
+	}
+	logger(r).Info("status updated", "job", j.Id(), "status", s)
+}
+
+func DeleteJob(w http.ResponseWriter, r *http.Request, j *Job) {
+	if err := idx.Delete(j, actor(r)); err != nil {
+		reportError(w, err, j.Id(), "Unable to delete job '"+j.Id()+"'")
 		return
 	}
-	log.Printf("Job '%s', status set to '%s'\n", j.Id(), s)
+	logger(r).Info("job deleted", "job", j.Id())
 }
 
 func GetData(w http.ResponseWriter, r *http.Request, j *Job) {
-	dta,err := j.Data()
-	if (err != nil) {
-		logInternalError(w, "Unable to read the data from the existing job '" + j.Id() + "'", err.Error())
+	dta, err := j.Data()
+	if err != nil {
+		logInternalError(w, "Unable to read the data from the existing job '"+j.Id()+"'", err.Error())
 		return
 	}
 	w.Write(dta)
 }
 
+func GetHistory(w http.ResponseWriter, r *http.Request, j *Job) {
+	h, err := idx.History(j.Id())
+	if err != nil {
+		reportError(w, err, j.Id(), "Unable to read the history of job '"+j.Id()+"'")
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(h)
+}
+
 func GetStatus(w http.ResponseWriter, r *http.Request, j *Job) {
 	dta := j.Status()
 	w.Write([]byte(dta.String()))
 }
 
-
 func GetJob(w http.ResponseWriter, r *http.Request, j *Job) {
 	w.Header().Set("content-type", "application/json")
-	buf := make(map[string]interface {})
+	buf := make(map[string]interface{})
 	buf["id"] = j.Id()
 	buf["status"] = j.Status().String()
-	buf["data"] = "http://" + r.Host + "/jobs/" + j.Id() + "/data"
-	buf["results"] = mapResults(j, "http://" + r.Host)
+	buf["since"] = j.Since().UTC()
+	buf["labels"] = j.Labels()
+	if !j.NotBefore().IsZero() {
+		buf["not_before"] = j.NotBefore().UTC()
+	}
+	p := j.Policy()
+	if !p.Deadline.IsZero() {
+		buf["deadline"] = p.Deadline.UTC()
+	}
+	if p.Timeout > 0 {
+		buf["timeout"] = p.Timeout.String()
+		buf["retries"] = p.Retries
+	}
+	if j.Attempts() > 0 {
+		buf["attempts"] = j.Attempts()
+	}
+	if s := j.Submitter(); s != "" {
+		buf["submitter"] = s
+	}
+	if reqs := j.Requirements(); !reqs.isZero() {
+		buf["requirements"] = reqs
+	}
+	if p, ok := j.Progress(); ok {
+		buf["progress"] = p
+	}
+	if a := j.LogAttempts(); len(a) > 0 {
+		buf["logs"] = a
+	}
+	if o := j.Owner(); o != "" {
+		buf["owner"] = o
+		//The job may be lost if its worker no longer heartbeats
+		buf["owner_stale"] = !idx.workers.alive(o)
+	}
+	buf["data"] = baseURL(r) + "/jobs/" + j.Id() + "/data"
+	buf["results"] = mapResults(j, baseURL(r), r.URL.Query().Get("details") != "")
 	enc := json.NewEncoder(w)
 	enc.Encode(buf)
 }
 
-func mapResults(j *Job, prefix string) map[string]string {
-	rr := make(map[string]string)
+// mapResults maps the results of a job to their URL or, with details, to
+// their description.
+func mapResults(j *Job, prefix string, details bool) map[string]interface{} {
+	rr := make(map[string]interface{})
 	for _, r := range j.Results() {
-		rr[r] = prefix + "/jobs/" + j.Id() + "/results/" + r
+		u := resultURL(prefix, j.Id(), r)
+		if !details {
+			rr[r] = u
+			continue
+		}
+		info, _ := j.ResultInfo(r)
+		res := make(map[string]interface{})
+		res["url"] = u
+		res["content_type"] = info.ContentType
+		res["size"] = info.Size
+		if info.Filename != "" {
+			res["filename"] = info.Filename
+		}
+		if len(info.Metadata) > 0 {
+			res["metadata"] = info.Metadata
+		}
+		rr[r] = res
 	}
 	return rr
 }
 
+// resultURL returns the URL of a result. Each segment of its name is
+// escaped.
+func resultURL(prefix, id, r string) string {
+	segs := strings.Split(r, "/")
+	for i, x := range segs {
+		segs[i] = url.PathEscape(x)
+	}
+	return prefix + "/jobs/" + url.PathEscape(id) + "/results/" + strings.Join(segs, "/")
+}
+
 func PushJob(w http.ResponseWriter, r *http.Request) {
+	limitBody(w, r, currentLimits().maxDataSize)
 	r.ParseForm()
 	jId := r.Form.Get("j")
 	if jId == "" {
-		http.Error(w, "Missing required parameter 'j' to declare the job identifier", http.StatusBadRequest)
+		badRequest(w, CodeMissingParameter, "Missing required parameter 'j' to declare the job identifier")
 		return
 	}
-	cnt, err := ioutil.ReadAll(r.Body)
-	if (err != nil) {
-		logInternalError(w, err.Error(), err.Error())
+	labels := make([]string, 0)
+	for _, l := range r.Form["l"] {
+		for _, x := range strings.Split(l, ",") {
+			if x = strings.TrimSpace(x); x != "" {
+				if strings.ContainsAny(x, " \t\n") {
+					badRequest(w, CodeInvalidParameter, "Invalid label '"+x+"'")
+					return
+				}
+				labels = append(labels, x)
+			}
+		}
+	}
+	notBefore, err := parseDate("not_before", r.Form.Get("not_before"))
+	if err != nil {
+		badRequest(w, CodeInvalidParameter, err.Error())
 		return
 	}
-	err = idx.NewJob(jId,cnt)
-	if (err != nil) {
-		if _,ok := err.(*os.PathError); ok { //Error on the fs, reported as a 500
-			logInternalError(w, "Error while creating the job", "Unable to create a job: " + err.Error())
-		} else { //Error at the job level, this means the job already exists
-			http.Error(w, err.Error(), http.StatusConflict)
-		}
+	policy, err := parsePolicy(r)
+	if err != nil {
+		badRequest(w, CodeInvalidParameter, err.Error())
+		return
+	}
+	reqs, err := parseRequirements(r)
+	if err != nil {
+		badRequest(w, CodeInvalidParameter, err.Error())
 		return
 	}
-	http.Redirect(w, r, "/jobs/" + jId, http.StatusCreated)
-	log.Printf("Job '%s' added\n", jId)
+	cnt, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	spec := JobSpec{Labels: labels, NotBefore: notBefore, Policy: policy, Requirements: reqs}
+	//A client identified by its token is the submitter, so it cannot use
+	//the quotas of another one
+	if who := actor(r).Who; who == anonymous || who == unknownToken {
+		spec.Submitter = r.Form.Get("submitter")
+	}
+	err = idx.NewJob(jId, cnt, spec, actor(r))
+	if err != nil {
+		reportError(w, err, jId, "Error while creating the job '"+jId+"'")
+		return
+	}
+	http.Redirect(w, r, baseURL(r)+"/jobs/"+jId, http.StatusCreated)
+	logger(r).Info("job added", "job", jId)
+}
+
+// parseDate parses the parameter p, a RFC 3339 date or a delay like '90s' or '2h'.
+func parseDate(p, s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return time.Now().Add(d), nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid parameter '%s': expected a RFC 3339 date or a delay like '2h', got '%s'", p, s)
+}
+
+// parsePolicy parses the limits of a job to submit.
+func parsePolicy(r *http.Request) (JobPolicy, error) {
+	var p JobPolicy
+	var err error
+	if p.Deadline, err = parseDate("deadline", r.Form.Get("deadline")); err != nil {
+		return p, err
+	}
+	if s := r.Form.Get("timeout"); s != "" {
+		if p.Timeout, err = time.ParseDuration(s); err != nil || p.Timeout <= 0 {
+			return p, fmt.Errorf("Invalid parameter 'timeout': expected a positive duration like '30m', got '%s'", s)
+		}
+	}
+	if s := r.Form.Get("retries"); s != "" {
+		if p.Retries, err = strconv.Atoi(s); err != nil || p.Retries < 0 {
+			return p, fmt.Errorf("Invalid parameter 'retries': expected a positive integer, got '%s'", s)
+		}
+	}
+	return p, nil
+}
+
+// parseRequirements parses the resources and the constraints of a job.
+func parseRequirements(r *http.Request) (Requirements, error) {
+	var reqs Requirements
+	var err error
+	if reqs.Resources, err = ParseQuantities(r.Form.Get("resources")); err != nil {
+		return reqs, err
+	}
+	if reqs.Constraints, err = ParseConstraints(r.Form.Get("constraints")); err != nil {
+		return reqs, err
+	}
+	return reqs, nil
+}
+
+// parseOffer parses the resources and the attributes a worker presents.
+func parseOffer(r *http.Request) (Offer, error) {
+	var o Offer
+	var err error
+	if o.Resources, err = ParseQuantities(r.Form.Get("resources")); err != nil {
+		return o, err
+	}
+	if o.Attributes, err = ParseAttributes(r.Form.Get("attributes")); err != nil {
+		return o, err
+	}
+	return o, nil
 }
 
 func GetResult(w http.ResponseWriter, r *http.Request, j *Job) {
 	id := mux.Vars(r)["r"]
 	ok, cnt, err := j.Result(id)
-	if (!ok) {
-		http.Error(w, "Result '" + id + "' not found", http.StatusNotFound)
+	if !ok {
+		writeError(w, http.StatusNotFound, &APIError{Code: CodeResultNotFound, Message: "Result '" + id + "' not found", Job: j.Id(), Result: id})
 		return
 	}
-	if (err != nil) {
-		logInternalError(w, "Unable to get the existing result '" + id + "'", err.Error())
+	if err != nil {
+		logInternalError(w, "Unable to get the existing result '"+id+"'", err.Error())
 		return
 	}
+	info, _ := j.ResultInfo(id)
+	w.Header().Set("content-type", info.ContentType)
+	if info.Filename != "" {
+		w.Header().Set("content-disposition", mime.FormatMediaType("inline", map[string]string{"filename": info.Filename}))
+	}
+	for k, v := range info.Metadata {
+		w.Header().Set(metaHeader+k, v)
+	}
 	w.Write(cnt)
 }
 
+// resultInfo extracts the description of a result from the request.
+// The filename is either given by the 'f' parameter or the
+// Content-Disposition header. Each 'X-Bip-Meta-*' header is a metadata.
+func resultInfo(r *http.Request, cnt []byte) Result {
+	info := Result{Filename: r.URL.Query().Get("f")}
+	if ct := r.Header.Get("content-type"); ct != "" {
+		info.ContentType = ct
+	} else {
+		info.ContentType = http.DetectContentType(cnt)
+	}
+	if info.Filename == "" {
+		if _, params, err := mime.ParseMediaType(r.Header.Get("content-disposition")); err == nil {
+			info.Filename = params["filename"]
+		}
+	}
+	for k, v := range r.Header {
+		if strings.HasPrefix(k, metaHeader) && len(k) > len(metaHeader) {
+			if info.Metadata == nil {
+				info.Metadata = make(map[string]string)
+			}
+			info.Metadata[strings.ToLower(k[len(metaHeader):])] = v[0]
+		}
+	}
+	return info
+}
+
 func PutResult(w http.ResponseWriter, r *http.Request, j *Job) {
-	r.ParseForm()
-	res := r.Form.Get("r")
+	//The body is the result, whatever its content type. So the form is not parsed
+	res := r.URL.Query().Get("r")
 	if res == "" {
-		http.Error(w, "Missing required parameter 'r' to declare the result identifier", http.StatusBadRequest)
+		badRequest(w, CodeMissingParameter, "Missing required parameter 'r' to declare the result identifier")
 		return
 	}
-	cnt, err := ioutil.ReadAll(r.Body)
-	if (err != nil) {
-		logInternalError(w, "Unable to read the result data", err.Error())
+	if err := CheckResultName(res); err != nil {
+		badRequest(w, CodeInvalidParameter, err.Error())
 		return
 	}
-	err = j.AddResult(res, cnt)
-	if (err != nil) {
-		if _,ok := err.(*os.PathError); ok { //Error on the fs, reported as a 500
-			logInternalError(w, "Error while storing the result data", err.Error())
-		} else  {
-			//The job already exists or the current status is incorrect
-			http.Error(w, err.Error(), http.StatusConflict)
-		}
-	}  else {
-		http.Redirect(w, r, "/jobs/" + j.Id() + "/results/" + res, http.StatusCreated)
-		log.Printf("Job '%s': result '%s' added\n", j.Id(), res)
+	limitBody(w, r, currentLimits().maxResultSize)
+	cnt, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	err := j.AddResult(res, cnt, resultInfo(r, cnt))
+	if err != nil {
+		reportError(w, err, j.Id(), "Error while storing the result data")
+	} else {
+		http.Redirect(w, r, resultURL(baseURL(r), j.Id(), res), http.StatusCreated)
+		logger(r).Info("result added", "job", j.Id(), "result", res, "size", len(cnt))
 	}
 }
 
+// GetResults lists the results of a job. The 'prefix' parameter restricts
+// the listing to the results in a given directory while the 'tree'
+// parameter nests the results according to their directories. The
+// 'details' parameter describes the results rather than giving their URL.
 func GetResults(w http.ResponseWriter, r *http.Request, j *Job) {
-	enc:= json.NewEncoder(w)
+	enc := json.NewEncoder(w)
 	w.Header().Set("content-type", "application/json")
-	enc.Encode(mapResults(j, "http://" + r.Host))
+	rr := mapResults(j, baseURL(r), r.URL.Query().Get("details") != "")
+	if prefix := strings.TrimSuffix(r.URL.Query().Get("prefix"), "/"); prefix != "" {
+		for id, _ := range rr {
+			if !strings.HasPrefix(id, prefix+"/") {
+				delete(rr, id)
+			}
+		}
+	}
+	if r.URL.Query().Get("tree") == "" {
+		enc.Encode(rr)
+		return
+	}
+	root := newResultsNode()
+	for id, res := range rr {
+		n := root
+		segs := strings.Split(id, "/")
+		for _, d := range segs[:len(segs)-1] {
+			if _, ok := n.Dirs[d]; !ok {
+				n.Dirs[d] = newResultsNode()
+			}
+			n = n.Dirs[d]
+		}
+		n.Results[segs[len(segs)-1]] = res
+	}
+	enc.Encode(root)
+}
+
+// resultsNode is a directory in the tree of results.
+type resultsNode struct {
+	Dirs    map[string]*resultsNode `json:"dirs"`
+	Results map[string]interface{}  `json:"results"`
+}
+
+func newResultsNode() *resultsNode {
+	return &resultsNode{make(map[string]*resultsNode), make(map[string]interface{})}
 }
 
 func PopJob(w http.ResponseWriter, r *http.Request) {
-	j, err := idx.ProcessFirstReady()
+	if refuseIfShuttingDown(w) {
+		return
+	}
+	r.ParseForm()
+	worker := r.Form.Get("worker")
+	if _, ok := idx.workers.get(worker); worker != "" && !ok {
+		workerNotFound(w, worker)
+		return
+	}
+	o, err := parseOffer(r)
+	if err != nil {
+		badRequest(w, CodeInvalidParameter, err.Error())
+		return
+	}
+	j, err := idx.ProcessFirstReady(worker, o, actor(r))
 	if err != nil {
-		logInternalError(w, "Error while getting a proccessable job", "Error while getting a proccessable job" + err.Error() + "\n")
-	} else if (j == nil) {
-		http.Error(w, "No jobs are waiting for being processed", http.StatusNoContent)
+		reportError(w, err, "", "Error while getting a proccessable job")
+	} else if j == nil {
+		//No jobs are waiting for being processed
+		w.WriteHeader(http.StatusNoContent)
 	} else {
-		http.Redirect(w, r, "http://" + r.Host + "/jobs/" + j.Id(), http.StatusFound)
-		log.Printf("Job '%s' is processing\n", j.Id())
+		http.Redirect(w, r, baseURL(r)+"/jobs/"+j.Id(), http.StatusFound)
+		logger(r).Info("job popped", "job", j.Id())
 	}
 }
 
 func GetJobs(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("content-type", "application/json")
 	enc := json.NewEncoder(w)
-	buf := make([]map[string]string, 0)
-	for _,id := range idx.ListJobs() {
-		j,_ := idx.GetJob(id)
-		job := make(map[string]string, 3)
+	buf := make([]map[string]interface{}, 0)
+	for _, id := range idx.ListJobs() {
+		j, _ := idx.GetJob(id)
+		job := make(map[string]interface{}, 4)
 		job["id"] = id
 		job["status"] = j.Status().String()
-		job["url"] = "http://" + r.Host + "/jobs/" + id
+		job["labels"] = j.Labels()
+		job["url"] = baseURL(r) + "/jobs/" + id
 		buf = append(buf, job)
 	}
 	enc.Encode(buf)
 }
 
+func archiveContentType(format string) string {
+	switch format {
+	case "zip":
+		return "application/zip"
+	case "tar.gz":
+		return "application/gzip"
+	}
+	return "application/x-tar"
+}
+
+// sendArchive streams the results of the jobs. The 'gzip' parameter
+// compresses a tar archive.
+func sendArchive(w http.ResponseWriter, r *http.Request, name string, jobs []*Job, flat bool) {
+	format := mux.Vars(r)["format"]
+	if format == "tar" && r.URL.Query().Get("gzip") != "" {
+		format = "tar.gz"
+	}
+	w.Header().Set("content-type", archiveContentType(format))
+	w.Header().Set("content-disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + "." + format}))
+	if err := WriteResults(w, format, jobs, flat); err != nil {
+		//The response is already partially sent, it is too late to report the error
+		logger(r).Error("unable to send the archive", "path", r.URL.Path, "error", err)
+	}
+}
+
+func GetResultsArchive(w http.ResponseWriter, r *http.Request, j *Job) {
+	sendArchive(w, r, j.Id(), []*Job{j}, true)
+}
+
+// GetJobsResultsArchive streams the results of the jobs selected by
+// their status ('s' parameter) and their label ('l' parameter).
+func GetJobsResultsArchive(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	jobs := idx.Select(q.Get("s"), q.Get("l"))
+	if len(jobs) == 0 {
+		writeError(w, http.StatusNotFound, &APIError{Code: CodeNoMatchingJob, Message: "No jobs are matching the selection"})
+		return
+	}
+	sendArchive(w, r, "results", jobs, false)
+}
@@ -0,0 +1,105 @@
+/**
+ * Handlers of the REST API.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// The results are listed with their URL unless described, and their URL
+// lead back to them whatever their name.
+func TestResultsListing(t *testing.T) {
+	i, err := NewIndex(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = i.NewJob("j", nil, JobSpec{}, System); err != nil {
+		t.Fatal(err)
+	}
+	j, _ := i.GetJob("j")
+	for _, step := range []func(Actor) error{func(by Actor) error { return j.Process("", by) }, j.Terminating} {
+		if err = step(System); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names := []string{"out.txt", "a b.txt", "plots/q?.png", "x#1", "100%"}
+	for _, r := range names {
+		if err = j.AddResult(r, []byte(r), Result{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	GetResults(rec, httptest.NewRequest("GET", "/jobs/j/results/", nil), j)
+	var urls map[string]string
+	if err = json.Unmarshal(rec.Body.Bytes(), &urls); err != nil {
+		t.Fatalf("expected the URL of each result: %s", err)
+	}
+	for _, r := range names {
+		u, err := url.Parse(urls[r])
+		if err != nil {
+			t.Errorf("'%s': %s", r, err)
+		} else if u.Path != "/jobs/j/results/"+r || u.RawQuery != "" || u.Fragment != "" {
+			t.Errorf("'%s': URL '%s' leads to '%s'", r, urls[r], u.Path)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	GetResults(rec, httptest.NewRequest("GET", "/jobs/j/results/?details=true", nil), j)
+	var details map[string]struct {
+		URL  string `json:"url"`
+		Size int64  `json:"size"`
+	}
+	if err = json.Unmarshal(rec.Body.Bytes(), &details); err != nil {
+		t.Fatalf("expected the description of each result: %s", err)
+	}
+	for _, r := range names {
+		if d := details[r]; d.URL != urls[r] || d.Size != int64(len(r)) {
+			t.Errorf("'%s': described by %+v", r, d)
+		}
+	}
+}
+
+// Only the clients without a declared token state the submitter of the
+// jobs they push.
+func TestPushJobSubmitter(t *testing.T) {
+	i, err := NewIndex(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := idx
+	idx = i
+	defer func() { idx = old }()
+	setTokens(map[string]string{"alice": "secret"})
+	defer setTokens(nil)
+
+	for _, tc := range []struct {
+		id, token, expected string
+	}{
+		{"a", "", "bob"},
+		{"b", "undeclared", "bob"},
+		{"c", "secret", "alice"},
+	} {
+		req := httptest.NewRequest("POST", "/jobs/?j="+tc.id+"&submitter=bob", strings.NewReader("x"))
+		if tc.token != "" {
+			req.Header.Set("authorization", "Bearer "+tc.token)
+		}
+		rec := httptest.NewRecorder()
+		req, _ = withActor(rec, req)
+		PushJob(rec, req)
+		if rec.Code != 201 {
+			t.Fatalf("'%s': got %d: %s", tc.id, rec.Code, rec.Body)
+		}
+		j, _ := i.GetJob(tc.id)
+		if j.Submitter() != tc.expected {
+			t.Errorf("'%s': submitted by '%s', expected '%s'", tc.id, j.Submitter(), tc.expected)
+		}
+	}
+}
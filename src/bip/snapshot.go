@@ -0,0 +1,418 @@
+/**
+ * Consistent snapshots of the whole store.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Name of the manifest that ends every snapshot.
+const SnapshotManifestName = "snapshot.json"
+
+// Version of the snapshot format.
+const snapshotVersion = 1
+
+// SnapshotJob describes a job in a snapshot. The data and the results
+// are identified by their SHA-256.
+type SnapshotJob struct {
+	Id      string            `json:"id"`
+	Status  string            `json:"status"`
+	Since   time.Time         `json:"since"`
+	Labels  []string          `json:"labels"`
+	Data    string            `json:"data"`
+	Results map[string]string `json:"results"`
+}
+
+// SnapshotManifest lists the content of a snapshot.
+type SnapshotManifest struct {
+	Version  int           `json:"version"`
+	Created  time.Time     `json:"created"`
+	Jobs     []SnapshotJob `json:"jobs"`
+	Archived []string      `json:"archived"`
+}
+
+// capturedJob is the state of a job when the snapshot started.
+type capturedJob struct {
+	j        *Job
+	status   JobStatus
+	since    time.Time
+	results  []string
+	attempts int
+	//The progress file, rewritten on every update
+	progress []byte
+	//The size of the logs of each attempt, which keep growing
+	logs []capturedLog
+}
+
+type capturedLog struct {
+	attempt int
+	size    int64
+}
+
+// capture takes the state of a job. The job must be frozen.
+func (j *Job) capture() (capturedJob, error) {
+	j.lock.Lock()
+	c := capturedJob{j: j, status: j.status, since: j.since, results: j.resultIds(), attempts: j.attempts}
+	j.lock.Unlock()
+	sort.Strings(c.results)
+	var err error
+	if c.progress, err = ioutil.ReadFile(j.root + "/progress"); os.IsNotExist(err) {
+		err = nil
+	} else if err != nil {
+		return c, err
+	}
+	for _, a := range j.LogAttempts() {
+		stat, err := os.Stat(j.logPath(a))
+		if err != nil {
+			return c, err
+		}
+		c.logs = append(c.logs, capturedLog{a, stat.Size()})
+	}
+	return c, nil
+}
+
+// Snapshot streams a gzip-compressed tar archive of the jobs, the audit
+// log, the recurring jobs and the archived jobs as they were when the snapshot started. The
+// changes are only blocked while the state is captured: the files that
+// are written once are streamed afterwards, and the statuses are taken
+// from the memory. Collections and archival operations wait for the end
+// of the snapshot.
+func (idx *Index) Snapshot(w io.Writer) error {
+	idx.collecting.Lock()
+	defer idx.collecting.Unlock()
+	idx.archiveLock.Lock()
+	defer idx.archiveLock.Unlock()
+
+	idx.cronLock.Lock()
+	crons, err := idx.marshalCrons()
+	if err != nil {
+		idx.cronLock.Unlock()
+		return err
+	}
+	idx.lock.RLock()
+	idx.frozen.Lock()
+	jobs := make([]capturedJob, 0, len(idx.jobs))
+	for _, j := range idx.jobs {
+		var c capturedJob
+		if c, err = j.capture(); err != nil {
+			break
+		}
+		jobs = append(jobs, c)
+	}
+	archived := make([]*Archived, 0, len(idx.archived))
+	for _, a := range idx.archived {
+		archived = append(archived, a)
+	}
+	var auditSize int64
+	if err == nil {
+		auditSize, err = idx.audit.size()
+	}
+	idx.frozen.Unlock()
+	idx.lock.RUnlock()
+	idx.cronLock.Unlock()
+	if err != nil {
+		return err
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].j.Id() < jobs[b].j.Id() })
+	sort.Slice(archived, func(a, b int) bool { return archived[a].Id < archived[b].Id })
+
+	gz := gzip.NewWriter(w)
+	s := &snapshotWriter{tar.NewWriter(gz)}
+	m := SnapshotManifest{Version: snapshotVersion, Created: time.Now().UTC(), Jobs: make([]SnapshotJob, 0), Archived: make([]string, 0)}
+	for _, c := range jobs {
+		sj, err := s.addJob(c)
+		if err != nil {
+			return err
+		}
+		m.Jobs = append(m.Jobs, sj)
+	}
+	if _, err = s.addFile(auditFile, idx.root+"/"+auditFile, auditSize); err != nil {
+		return err
+	}
+	for _, a := range archived {
+		if _, err = s.addFile(defaultArchiveDir+"/"+filepath.Base(a.Path), a.Path, -1); err != nil {
+			return err
+		}
+		m.Archived = append(m.Archived, a.Id)
+	}
+	if _, err = s.add(cronFile, m.Created, crons); err != nil {
+		return err
+	}
+	cnt, err := json.MarshalIndent(archived, "", " ")
+	if err != nil {
+		return err
+	}
+	if _, err = s.add(defaultArchiveDir+"/"+catalogueFile, m.Created, cnt); err != nil {
+		return err
+	}
+	if cnt, err = json.MarshalIndent(m, "", " "); err != nil {
+		return err
+	}
+	if _, err = s.add(SnapshotManifestName, m.Created, cnt); err != nil {
+		return err
+	}
+	if err = s.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+type snapshotWriter struct {
+	*tar.Writer
+}
+
+// add stores a file from the memory and returns its SHA-256.
+func (s *snapshotWriter) add(name string, mod time.Time, cnt []byte) (string, error) {
+	return s.copy(name, mod, int64(len(cnt)), bytes.NewReader(cnt))
+}
+
+// addFile stores the first size bytes of a file, or the whole file if
+// size is negative, and returns its SHA-256.
+func (s *snapshotWriter) addFile(name, p string, size int64) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if size < 0 {
+		size = stat.Size()
+	}
+	return s.copy(name, stat.ModTime(), size, io.LimitReader(f, size))
+}
+
+func (s *snapshotWriter) copy(name string, mod time.Time, size int64, in io.Reader) (string, error) {
+	hdr := &tar.Header{Name: name, Mode: 0600, Size: size, ModTime: mod, Typeflag: tar.TypeReg, Format: tar.FormatPAX}
+	if err := s.WriteHeader(hdr); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(s.Writer, h), in); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// addJob stores the files of a job as captured.
+func (s *snapshotWriter) addJob(c capturedJob) (SnapshotJob, error) {
+	j := c.j
+	sj := SnapshotJob{Id: j.Id(), Status: c.status.String(), Since: c.since, Labels: j.Labels(), Results: make(map[string]string)}
+	prefix := j.Id() + "/"
+	var err error
+	if _, err = s.add(prefix+"status", c.since, []byte{byte(c.status)}); err != nil {
+		return sj, err
+	}
+	if sj.Data, err = s.addFile(prefix+"data", j.root+"/data", -1); err != nil {
+		return sj, err
+	}
+	if len(j.Labels()) > 0 {
+		if _, err = s.addFile(prefix+"labels", j.root+"/labels", -1); err != nil {
+			return sj, err
+		}
+	}
+	if !j.NotBefore().IsZero() {
+		if _, err = s.addFile(prefix+"not_before", j.root+"/not_before", -1); err != nil {
+			return sj, err
+		}
+	}
+	if !j.Policy().isZero() {
+		if _, err = s.addFile(prefix+"policy", j.root+"/policy", -1); err != nil {
+			return sj, err
+		}
+	}
+	if !j.Requirements().isZero() {
+		if _, err = s.addFile(prefix+"requirements", j.root+"/requirements", -1); err != nil {
+			return sj, err
+		}
+	}
+	if len(c.progress) > 0 {
+		if _, err = s.add(prefix+"progress", c.since, c.progress); err != nil {
+			return sj, err
+		}
+	}
+	if j.Submitter() != "" {
+		if _, err = s.addFile(prefix+"submitter", j.root+"/submitter", -1); err != nil {
+			return sj, err
+		}
+	}
+	if c.attempts > 0 {
+		if _, err = s.add(prefix+"attempts", c.since, []byte(strconv.Itoa(c.attempts))); err != nil {
+			return sj, err
+		}
+	}
+	for _, l := range c.logs {
+		n := "logs/" + strconv.Itoa(l.attempt)
+		if _, err = s.addFile(prefix+n, j.root+"/"+n, l.size); err != nil {
+			return sj, err
+		}
+	}
+	for _, r := range c.results {
+		if _, err = os.Stat(j.root + "/meta/" + r); err == nil {
+			if _, err = s.addFile(prefix+"meta/"+r, j.root+"/meta/"+r, -1); err != nil {
+				return sj, err
+			}
+		}
+		if sj.Results[r], err = s.addFile(prefix+"results/"+r, j.root+"/results/"+r, -1); err != nil {
+			return sj, err
+		}
+	}
+	return sj, nil
+}
+
+// RestoreSnapshot rebuilds a storage root from a snapshot. The archived
+// jobs are restored in the archive directory, '<root>/.archive' if empty.
+// The root and the archive directory must not exist or be empty.
+func RestoreSnapshot(in io.Reader, root, archive string) (*SnapshotManifest, error) {
+	archive = archiveDir(root, archive)
+	for _, d := range []string{root, archive} {
+		if cnt, err := ioutil.ReadDir(d); err == nil && len(cnt) > 0 {
+			return nil, fmt.Errorf("'%s' is not empty", d)
+		}
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return nil, err
+		}
+	}
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	var m *SnapshotManifest
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if hdr.Name == SnapshotManifestName {
+			m = &SnapshotManifest{}
+			if err = json.NewDecoder(tr).Decode(m); err != nil {
+				return nil, fmt.Errorf("%s: %s", SnapshotManifestName, err)
+			}
+			continue
+		}
+		if err = CheckResultName(hdr.Name); err != nil {
+			return nil, fmt.Errorf("illegal path '%s'", hdr.Name)
+		}
+		p := filepath.Join(root, filepath.FromSlash(hdr.Name))
+		if strings.HasPrefix(hdr.Name, defaultArchiveDir+"/") {
+			p = filepath.Join(archive, filepath.FromSlash(strings.TrimPrefix(hdr.Name, defaultArchiveDir+"/")))
+		}
+		if err = os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			return nil, err
+		}
+		out, err := os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return nil, err
+		}
+		if err = os.Chtimes(p, hdr.ModTime, hdr.ModTime); err != nil {
+			return nil, err
+		}
+	}
+	if m == nil {
+		return nil, fmt.Errorf("truncated snapshot: no '%s'", SnapshotManifestName)
+	}
+	if m.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", m.Version)
+	}
+	for _, sj := range m.Jobs {
+		//A job without results has no results directory in the snapshot
+		if err = os.MkdirAll(filepath.Join(root, sj.Id, "results"), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// VerifySnapshot checks a restored root holds the jobs of the manifest
+// with the same status, data and results, and its archive directory the
+// archived jobs. The root is left untouched.
+func VerifySnapshot(m *SnapshotManifest, root, archive string) error {
+	for _, sj := range m.Jobs {
+		p := filepath.Join(root, sj.Id)
+		status, err := ioutil.ReadFile(p + "/status")
+		if err != nil || len(status) != 1 {
+			return fmt.Errorf("job '%s': no status", sj.Id)
+		}
+		if s := JobStatus(status[0]).String(); s != sj.Status {
+			return fmt.Errorf("job '%s': status '%s', expected '%s'", sj.Id, s, sj.Status)
+		}
+		if h, err := fileSHA256(p + "/data"); err != nil || h != sj.Data {
+			return fmt.Errorf("job '%s': data differ", sj.Id)
+		}
+		results, err := readResults(p)
+		if err != nil {
+			return fmt.Errorf("job '%s': %s", sj.Id, err)
+		}
+		if len(results) != len(sj.Results) {
+			return fmt.Errorf("job '%s': %d result(s), %d expected", sj.Id, len(results), len(sj.Results))
+		}
+		for r, expected := range sj.Results {
+			if h, err := fileSHA256(p + "/results/" + r); err != nil || h != expected {
+				return fmt.Errorf("job '%s': result '%s' differ", sj.Id, r)
+			}
+		}
+	}
+	for _, id := range m.Archived {
+		if _, err := os.Stat(filepath.Join(archiveDir(root, archive), id+".tar.gz")); err != nil {
+			return fmt.Errorf("archived job '%s': %s", id, err)
+		}
+	}
+	return nil
+}
+
+func fileSHA256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// GetSnapshot streams a snapshot of the store.
+func GetSnapshot(w http.ResponseWriter, r *http.Request) {
+	name := "bip-snapshot-" + time.Now().UTC().Format("20060102T150405Z") + ".tar.gz"
+	w.Header().Set("content-type", "application/gzip")
+	w.Header().Set("content-disposition", "attachment; filename=\""+name+"\"")
+	if err := idx.Snapshot(w); err != nil {
+		//The response is already started, the client gets a truncated archive
+		logger(r).Error("snapshot failed", "error", err)
+		return
+	}
+	logger(r).Info("snapshot sent")
+}
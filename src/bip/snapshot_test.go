@@ -0,0 +1,238 @@
+/**
+ * Round trip of the snapshots.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The archived jobs are restored in the archive directory the restored
+// index is loaded with.
+func TestSnapshotRestoresArchiveDir(t *testing.T) {
+	idx, err := NewIndex(t.TempDir(), filepath.Join(t.TempDir(), "archive"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := lead(t, idx, fixture{"old", JobSpec{}, terminated, map[string]string{"r": "old"}})
+	if _, err = idx.Archive(old, System); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = idx.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	root, archive := t.TempDir(), filepath.Join(t.TempDir(), "archive")
+	m, err := RestoreSnapshot(&buf, root, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifySnapshot(m, root, archive); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(root, defaultArchiveDir)); !os.IsNotExist(err) {
+		t.Errorf("the archived jobs are restored in the storage root")
+	}
+	restored, err := NewIndex(root, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = restored.Restore("old", System); err != nil {
+		t.Errorf("the archived job is not available: %s", err)
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	idx, err := NewIndex(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fixtures {
+		lead(t, idx, f)
+	}
+	old := lead(t, idx, fixture{"old", JobSpec{}, terminated, map[string]string{"r": "old"}})
+	if _, err = idx.Archive(old, System); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err = idx.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	m, err := RestoreSnapshot(&buf, root, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifySnapshot(m, root, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Jobs) != len(fixtures) {
+		t.Errorf("%d job(s) in the manifest, %d expected", len(m.Jobs), len(fixtures))
+	}
+	if !reflect.DeepEqual(m.Archived, []string{"old"}) {
+		t.Errorf("archived jobs %v, expected [old]", m.Archived)
+	}
+
+	//The statuses are read before the restored jobs are resumed
+	statuses := make(map[string]JobStatus)
+	for _, f := range fixtures {
+		cnt, err := ioutil.ReadFile(filepath.Join(root, f.id, "status"))
+		if err != nil || len(cnt) != 1 {
+			t.Fatalf("%s: no status", f.id)
+		}
+		statuses[f.id] = JobStatus(cnt[0])
+	}
+	restored, err := NewIndex(root, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fixtures {
+		j, _ := idx.GetJob(f.id)
+		r, ok := restored.GetJob(f.id)
+		if !ok {
+			t.Errorf("%s: not restored", f.id)
+			continue
+		}
+		compareJobs(t, j, r, statuses[f.id])
+	}
+	if _, ok := restored.GetArchived("old"); !ok {
+		t.Errorf("old: not restored in the archive")
+	}
+	if _, ok := restored.GetJob("old"); ok {
+		t.Errorf("old: restored as a live job")
+	}
+}
+
+// compareJobs checks a restored job matches the original one, field by field.
+func compareJobs(t *testing.T, j, r *Job, status JobStatus) {
+	id := j.Id()
+	if status != j.Status() {
+		t.Errorf("%s: status '%s', expected '%s'", id, status, j.Status())
+	}
+	if strings.Join(r.Labels(), ",") != strings.Join(j.Labels(), ",") {
+		t.Errorf("%s: labels %v, expected %v", id, r.Labels(), j.Labels())
+	}
+	if !r.NotBefore().Equal(j.NotBefore()) {
+		t.Errorf("%s: not before %s, expected %s", id, r.NotBefore(), j.NotBefore())
+	}
+	if r.Policy().Timeout != j.Policy().Timeout || r.Policy().Retries != j.Policy().Retries {
+		t.Errorf("%s: policy %+v, expected %+v", id, r.Policy(), j.Policy())
+	}
+	if r.Submitter() != j.Submitter() {
+		t.Errorf("%s: submitter '%s', expected '%s'", id, r.Submitter(), j.Submitter())
+	}
+	if r.Attempts() != j.Attempts() {
+		t.Errorf("%s: %d attempt(s), expected %d", id, r.Attempts(), j.Attempts())
+	}
+	data, _ := r.Data()
+	expected, _ := j.Data()
+	if !bytes.Equal(data, expected) {
+		t.Errorf("%s: data '%s', expected '%s'", id, data, expected)
+	}
+	got, want := r.Results(), j.Results()
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: results %v, expected %v", id, got, want)
+		return
+	}
+	for _, x := range want {
+		_, cnt, _ := r.Result(x)
+		_, expected, _ := j.Result(x)
+		if !bytes.Equal(cnt, expected) {
+			t.Errorf("%s: result '%s' is '%s', expected '%s'", id, x, cnt, expected)
+		}
+		info, _ := r.ResultInfo(x)
+		expectedInfo, _ := j.ResultInfo(x)
+		if !reflect.DeepEqual(info, expectedInfo) {
+			t.Errorf("%s: result '%s' described by %+v, expected %+v", id, x, info, expectedInfo)
+		}
+	}
+}
+
+// The snapshots must not fail, nor be torn, while the jobs change.
+func TestSnapshotDuringChanges(t *testing.T) {
+	idx, err := NewIndex(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := lead(t, idx, fixture{"running", JobSpec{}, processing, nil})
+	//A long history makes the progress file long to copy
+	long := strings.Repeat("step ", 500)
+	for i := 0; i < maxProgress; i++ {
+		if _, err = j.SetProgress(float64(i), long, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := j.SetProgress(float64(i%100), long, nil); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	logs, feed := io.Pipe()
+	go func() {
+		if _, _, err := j.AppendLog(logs); err != nil {
+			t.Error(err)
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-stop:
+				feed.Close()
+				return
+			case <-time.After(time.Millisecond):
+				fmt.Fprintln(feed, "line")
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	for i := 0; i < 20; i++ {
+		var buf bytes.Buffer
+		if err = idx.Snapshot(&buf); err != nil {
+			t.Fatalf("snapshot %d: %s", i, err)
+		}
+		root := t.TempDir()
+		if _, err = RestoreSnapshot(&buf, root, ""); err != nil {
+			t.Fatalf("snapshot %d: %s", i, err)
+		}
+		cnt, err := ioutil.ReadFile(filepath.Join(root, "running", "progress"))
+		if err != nil {
+			t.Fatalf("snapshot %d: %s", i, err)
+		}
+		for _, l := range strings.Split(strings.TrimSuffix(string(cnt), "\n"), "\n") {
+			var p Progress
+			if err = json.Unmarshal([]byte(l), &p); err != nil {
+				t.Fatalf("snapshot %d: torn progress: %s", i, err)
+			}
+		}
+	}
+}
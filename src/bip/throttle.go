@@ -0,0 +1,224 @@
+/**
+ * Rate limiting of the requests, and limits on the connections.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Number of buckets above which the full ones are forgotten.
+const maxBuckets = 10000
+
+// bucket is a token bucket. It is full when unused.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter keeps a token bucket per client.
+type limiter struct {
+	lock    sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newLimiter() *limiter {
+	return &limiter{buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token from the bucket of a client, refilled at rate
+// tokens per second up to burst. Otherwise, it returns how long to wait
+// for the next token.
+func (l *limiter) allow(key string, rate float64, burst int, now time.Time) (bool, time.Duration) {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.forget(rate, burst, now)
+		}
+		b = &bucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// forget removes the buckets that are full again.
+func (l *limiter) forget(rate float64, burst int, now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst) {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+var (
+	byIP    = newLimiter()
+	byToken = newLimiter()
+)
+
+// clientIP returns the address of a TCP client, or an empty string.
+func clientIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// throttle refuses the requests beyond the rate of the client address,
+// or of the token, with 429 and the delay to wait in 'Retry-After'.
+// Anonymous requests are only limited per address.
+func throttle(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := currentThrottle()
+		now := time.Now()
+		if ip := clientIP(r.RemoteAddr); ip != "" && t.IPRate > 0 {
+			if ok, wait := byIP.allow(ip, t.IPRate, t.IPBurst, now); !ok {
+				tooManyRequests(w, "ip", wait, "Too many requests from "+ip)
+				return
+			}
+		}
+		if who := actor(r).Who; who != anonymous && who != unknownToken && t.TokenRate > 0 {
+			if ok, wait := byToken.allow(who, t.TokenRate, t.TokenBurst, now); !ok {
+				tooManyRequests(w, "token", wait, "Too many requests from '"+who+"'")
+				return
+			}
+		}
+		if t.bodyTimeout > 0 && r.Body != nil && r.Body != http.NoBody {
+			r.Body = &slowBodyReader{r.Body, http.NewResponseController(w), t.bodyTimeout}
+		}
+		fn(w, r)
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, reason string, wait time.Duration, msg string) {
+	secs := retryAfter(wait)
+	metrics.throttled(reason)
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	writeError(w, http.StatusTooManyRequests, &APIError{Code: CodeRateLimited,
+		Message: fmt.Sprintf("%s. Retry in %ds", msg, secs)})
+}
+
+// slowBodyReader fails the reads of a request body once the client sent
+// nothing for longer than the timeout.
+type slowBodyReader struct {
+	io.ReadCloser
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (b *slowBodyReader) Read(p []byte) (int, error) {
+	b.rc.SetReadDeadline(time.Now().Add(b.timeout))
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = errBodyTimeout
+	}
+	return n, err
+}
+
+var errBodyTimeout = errors.New("the client sent nothing for too long")
+
+// connLimiter caps the connections accepted by a listener, in total and
+// per client address. The connections beyond are answered with 429 and
+// closed.
+type connLimiter struct {
+	net.Listener
+	lock  sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func limitConnections(l net.Listener) net.Listener {
+	return &connLimiter{Listener: l, perIP: make(map[string]int)}
+}
+
+func (l *connLimiter) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := ""
+		if a, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+			ip = a.IP.String()
+		}
+		if l.acquire(ip) {
+			return &limitedConn{Conn: c, l: l, ip: ip}, nil
+		}
+		metrics.throttled("connections")
+		slog.Debug("connection refused", "client", c.RemoteAddr().String())
+		go refuseConnection(c)
+	}
+}
+
+func (l *connLimiter) acquire(ip string) bool {
+	t := currentThrottle()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if t.MaxConnections > 0 && l.total >= t.MaxConnections {
+		return false
+	}
+	if ip != "" && t.MaxConnectionsPerIP > 0 && l.perIP[ip] >= t.MaxConnectionsPerIP {
+		return false
+	}
+	l.total++
+	if ip != "" {
+		l.perIP[ip]++
+	}
+	return true
+}
+
+func (l *connLimiter) release(ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.total--
+	if ip != "" {
+		if l.perIP[ip]--; l.perIP[ip] == 0 {
+			delete(l.perIP, ip)
+		}
+	}
+}
+
+// refuseConnection answers 429 to a connection, then closes it.
+func refuseConnection(c net.Conn) {
+	defer c.Close()
+	body := `{"code":"` + CodeRateLimited + `","message":"Too many connections. Retry in 1s"}` + "\n"
+	c.SetWriteDeadline(time.Now().Add(time.Second))
+	fmt.Fprintf(c, "HTTP/1.1 429 Too Many Requests\r\nContent-Type: application/json\r\nRetry-After: 1\r\n"+
+		"Connection: close\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+// limitedConn releases its slot once closed.
+type limitedConn struct {
+	net.Conn
+	l    *connLimiter
+	ip   string
+	once sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() { c.l.release(c.ip) })
+	return c.Conn.Close()
+}
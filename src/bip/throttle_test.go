@@ -0,0 +1,97 @@
+/**
+ * Rate limiting of the requests, and limits on the connections.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"testing"
+	"time"
+)
+
+// A bucket lets a burst through, then refills at the rate.
+func TestLimiterAllow(t *testing.T) {
+	start := time.Now()
+	for _, tc := range []struct {
+		name  string
+		rate  float64
+		burst int
+		//When the requests are sent, and which ones are allowed
+		at      []time.Duration
+		allowed string
+	}{
+		{"burst", 1, 3, []time.Duration{0, 0, 0, 0}, "yyyn"},
+		{"refill", 2, 1, []time.Duration{0, 0, 500 * time.Millisecond, 600 * time.Millisecond}, "ynyn"},
+		{"capped refill", 1, 2, []time.Duration{0, 0, time.Hour, time.Hour, time.Hour}, "yyyyn"},
+		{"default burst", 2.5, 0, []time.Duration{0, 0, 0, 0}, "yyyn"},
+	} {
+		l := newLimiter()
+		res := ""
+		for _, d := range tc.at {
+			ok, wait := l.allow("k", tc.rate, tc.burst, start.Add(d))
+			if ok {
+				res += "y"
+			} else if wait <= 0 || wait > time.Duration(float64(time.Second)/tc.rate) {
+				t.Errorf("%s: wait %s for the next token", tc.name, wait)
+			} else {
+				res += "n"
+			}
+		}
+		if res != tc.allowed {
+			t.Errorf("%s: allowed '%s', expected '%s'", tc.name, res, tc.allowed)
+		}
+	}
+}
+
+// Each client has its own bucket, and the full ones are forgotten.
+func TestLimiterForget(t *testing.T) {
+	l := newLimiter()
+	now := time.Now()
+	if ok, _ := l.allow("a", 1, 1, now); !ok {
+		t.Fatal("expected the first request of 'a' to be allowed")
+	}
+	if ok, _ := l.allow("b", 1, 1, now); !ok {
+		t.Errorf("'b' is limited by the requests of 'a'")
+	}
+	l.allow("c", 1, 1, now.Add(1500*time.Millisecond))
+	l.forget(1, 1, now.Add(1600*time.Millisecond))
+	if _, ok := l.buckets["c"]; len(l.buckets) != 1 || !ok {
+		t.Errorf("buckets %v, expected only 'c' as it is not full yet", l.buckets)
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	limitsLock.Lock()
+	old := throttling
+	throttling = ThrottleConfig{MaxConnections: 3, MaxConnectionsPerIP: 2}
+	limitsLock.Unlock()
+	defer func() {
+		limitsLock.Lock()
+		throttling = old
+		limitsLock.Unlock()
+	}()
+
+	l := &connLimiter{perIP: make(map[string]int)}
+	res := ""
+	for _, ip := range []string{"a", "a", "a", "b", "b"} {
+		if l.acquire(ip) {
+			res += "y"
+		} else {
+			res += "n"
+		}
+	}
+	if res != "yynyn" {
+		t.Errorf("accepted '%s', expected 'yynyn'", res)
+	}
+	l.release("a")
+	if !l.acquire("b") || l.acquire("a") {
+		t.Errorf("expected a released connection to be available to any address within its cap")
+	}
+	l.release("a")
+	l.release("b")
+	l.release("b")
+	if l.total != 0 || len(l.perIP) != 0 {
+		t.Errorf("%d connection(s), %v per address once released, expected none", l.total, l.perIP)
+	}
+}
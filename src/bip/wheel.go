@@ -0,0 +1,133 @@
+/**
+ * Promotion of the scheduled jobs, and enforcement of the job limits.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Resolution and number of slots of the timer wheel. A timer further than
+// one revolution stays in its slot for the following revolutions.
+const (
+	wheelTick  = time.Second
+	wheelSlots = 3600
+)
+
+type timer struct {
+	id string
+	at time.Time
+}
+
+// timerWheel is a hashed timer wheel: a timer is stored in the slot of
+// its due date, and every tick inspects a single slot.
+type timerWheel struct {
+	lock  sync.Mutex
+	slots [][]timer
+	pos   int
+	//The moment of the current slot
+	now time.Time
+}
+
+func newTimerWheel(now time.Time) *timerWheel {
+	return &timerWheel{slots: make([][]timer, wheelSlots), now: now}
+}
+
+// add registers a timer. A past due date fires on the next tick.
+func (w *timerWheel) add(id string, at time.Time) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	ticks := int((at.Sub(w.now) + wheelTick - 1) / wheelTick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	s := (w.pos + ticks%wheelSlots) % wheelSlots
+	w.slots[s] = append(w.slots[s], timer{id, at})
+}
+
+// advance moves the wheel up to now and returns the timers that are due.
+func (w *timerWheel) advance(now time.Time) []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	due := make([]string, 0)
+	for !w.now.Add(wheelTick).After(now) {
+		w.now = w.now.Add(wheelTick)
+		w.pos = (w.pos + 1) % wheelSlots
+		later := w.slots[w.pos][:0]
+		for _, t := range w.slots[w.pos] {
+			if t.at.After(w.now) {
+				later = append(later, t)
+			} else {
+				due = append(due, t.id)
+			}
+		}
+		w.slots[w.pos] = later
+	}
+	return due
+}
+
+// enforce checks the jobs having a due timer. The scheduled jobs become
+// ready, the jobs past their deadline expire, and the processings past
+// their timeout end. A timer may be outdated, the job is checked anyway.
+func (idx *Index) enforce(now time.Time) {
+	for _, id := range idx.wheel.advance(now) {
+		j, ok := idx.GetJob(id)
+		if !ok {
+			continue
+		}
+		//The status is checked and changed at once
+		err := j.locked(func() error {
+			switch s := j.status; {
+			case (s == scheduled || s == ready) && j.pastDeadline(now):
+				return j.switchLocked(s, expired, System)
+			case s == scheduled && !j.notBefore.After(now):
+				return j.switchLocked(scheduled, ready, System)
+			case j.pastTimeout(now):
+				slog.Warn("processing timeout", "job", id, "attempt", j.attempts, "timeout", j.policy.Timeout.String())
+				metrics.timedOut()
+				return j.switchLocked(processing, j.afterTimeout(), System)
+			}
+			return nil
+		})
+		if err != nil {
+			slog.Error("unable to enforce the limits of a job", "job", id, "error", err)
+		}
+	}
+}
+
+// StartScheduler promotes the scheduled jobs once due, enforces the limits
+// of the jobs, spawns the jobs of the recurring ones and flags the stale
+// workers, in background.
+func (idx *Index) StartScheduler() {
+	idx.stopScheduler = make(chan struct{})
+	idx.schedulerStopped = make(chan struct{})
+	go func() {
+		defer close(idx.schedulerStopped)
+		t := time.NewTicker(wheelTick)
+		defer t.Stop()
+		for {
+			select {
+			case <-idx.stopScheduler:
+				return
+			case now := <-t.C:
+				idx.enforce(now)
+				idx.runCrons(now)
+				idx.workers.check(now, currentWorkers().staleAfter)
+			}
+		}
+	}()
+}
+
+// StopScheduler stops the promotion of the scheduled jobs, the enforcement
+// of the limits and the recurring jobs.
+func (idx *Index) StopScheduler() {
+	if idx.stopScheduler == nil {
+		return
+	}
+	close(idx.stopScheduler)
+	<-idx.schedulerStopped
+}
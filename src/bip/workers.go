@@ -0,0 +1,353 @@
+/**
+ * Registry of the workers processing the jobs.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Worker describes a registered worker and the jobs it is processing.
+type Worker struct {
+	Name   string   `json:"name"`
+	Host   string   `json:"host"`
+	Labels []string `json:"labels"`
+	//The maximum number of jobs processed at once. 0 means no limit
+	MaxConcurrency int       `json:"max_concurrency"`
+	Registered     time.Time `json:"registered"`
+	LastSeen       time.Time `json:"last_seen"`
+	Jobs           []string  `json:"jobs"`
+	//The number of jobs the worker terminated, and failed or let expire
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+	//No heartbeat received for longer than the stale delay
+	Stale bool `json:"stale"`
+	//The last offer of the worker, and the resources held by its jobs
+	Resources  map[string]int64  `json:"resources,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Held       map[string]int64  `json:"held,omitempty"`
+
+	//The resources held by each job
+	needs map[string]map[string]int64
+}
+
+// WorkerError reports an unknown worker, or a worker that cannot process
+// one more job.
+type WorkerError struct {
+	Name string
+	Busy bool
+}
+
+func (err *WorkerError) Error() string {
+	if err.Busy {
+		return fmt.Sprintf("Worker '%s' is processing as many jobs as allowed, or lacks resources", err.Name)
+	}
+	return fmt.Sprintf("Worker '%s' is not registered", err.Name)
+}
+
+// registry tracks the workers. It lives in memory: after a restart of
+// bipd, the workers register again.
+type registry struct {
+	lock    sync.Mutex
+	workers map[string]*Worker
+}
+
+func newRegistry() *registry {
+	return &registry{workers: make(map[string]*Worker)}
+}
+
+// register adds a worker, or updates it if it is registered already. The
+// jobs and the counters of a worker registering again are kept.
+func (r *registry) register(w Worker) Worker {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	if prev, ok := r.workers[w.Name]; ok {
+		prev.Host, prev.Labels, prev.MaxConcurrency = w.Host, w.Labels, w.MaxConcurrency
+		prev.LastSeen = now
+		prev.Stale = false
+		return prev.copy()
+	}
+	w.Registered, w.LastSeen = now, now
+	w.Jobs = make([]string, 0)
+	w.Held = make(map[string]int64)
+	w.needs = make(map[string]map[string]int64)
+	r.workers[w.Name] = &w
+	return w.copy()
+}
+
+func (r *registry) unregister(name string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, ok := r.workers[name]
+	delete(r.workers, name)
+	return ok
+}
+
+func (w *Worker) copy() Worker {
+	c := *w
+	c.Jobs = append(make([]string, 0, len(w.Jobs)), w.Jobs...)
+	c.Held = make(map[string]int64)
+	for k, v := range w.Held {
+		if v != 0 {
+			c.Held[k] = v
+		}
+	}
+	c.needs = nil
+	return c
+}
+
+// offer records the offer of a worker. It returns the offer completed
+// with the previous one and the labels of the worker, and the resources
+// held by its jobs.
+func (r *registry) offer(name string, o Offer) (Offer, map[string]int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	w, ok := r.workers[name]
+	if !ok {
+		return o, nil
+	}
+	if len(o.Resources) > 0 {
+		w.Resources = o.Resources
+	}
+	if len(o.Attributes) > 0 {
+		w.Attributes = o.Attributes
+	}
+	res := Offer{Resources: w.Resources, Attributes: make(map[string]string)}
+	for _, l := range w.Labels {
+		res.Attributes[l] = ""
+	}
+	for k, v := range w.Attributes {
+		res.Attributes[k] = v
+	}
+	held := make(map[string]int64)
+	for k, v := range w.Held {
+		held[k] = v
+	}
+	return res, held
+}
+
+// heartbeat records a worker is alive.
+func (r *registry) heartbeat(name string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	w, ok := r.workers[name]
+	if !ok {
+		return &WorkerError{Name: name}
+	}
+	if w.Stale {
+		slog.Info("worker is back", "worker", name)
+	}
+	w.LastSeen = time.Now()
+	w.Stale = false
+	return nil
+}
+
+// errHeld signals a worker asks for a job it already holds.
+var errHeld = errors.New("the job is already held by the worker")
+
+// reserve assigns a job to a worker, if it can take one more job and
+// has the resources the job needs left. The worker is alive as it asks
+// for a job. A job already held is not reserved twice.
+func (r *registry) reserve(name, job string, needs map[string]int64) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	w, ok := r.workers[name]
+	if !ok {
+		return &WorkerError{Name: name}
+	}
+	w.LastSeen = time.Now()
+	w.Stale = false
+	for _, x := range w.Jobs {
+		if x == job {
+			return errHeld
+		}
+	}
+	if w.MaxConcurrency > 0 && len(w.Jobs) >= w.MaxConcurrency {
+		return &WorkerError{Name: name, Busy: true}
+	}
+	//Only the resources the worker presented are bounded
+	for k, n := range needs {
+		if avail, ok := w.Resources[k]; ok && w.Held[k]+n > avail {
+			return &WorkerError{Name: name, Busy: true}
+		}
+	}
+	for k, n := range needs {
+		w.Held[k] += n
+	}
+	w.needs[job] = needs
+	w.Jobs = append(w.Jobs, job)
+	return nil
+}
+
+// release removes a job from the jobs of a worker. to is the status the
+// job reached.
+func (r *registry) release(name, job string, to JobStatus) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	w, ok := r.workers[name]
+	if !ok {
+		return
+	}
+	for i, x := range w.Jobs {
+		if x == job {
+			w.Jobs = append(w.Jobs[:i], w.Jobs[i+1:]...)
+			break
+		}
+	}
+	for k, n := range w.needs[job] {
+		w.Held[k] -= n
+	}
+	delete(w.needs, job)
+	switch to {
+	case terminated:
+		w.Completed++
+	case failed, expired:
+		w.Failed++
+	}
+}
+
+// alive indicates if a worker is registered and not stale.
+func (r *registry) alive(name string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	w, ok := r.workers[name]
+	return ok && !w.Stale
+}
+
+// check flags the workers without heartbeat for longer than staleAfter.
+func (r *registry) check(now time.Time, staleAfter time.Duration) {
+	if staleAfter == 0 {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, w := range r.workers {
+		if !w.Stale && now.Sub(w.LastSeen) > staleAfter {
+			w.Stale = true
+			slog.Warn("worker is stale", "worker", w.Name, "last_seen", w.LastSeen, "jobs", w.Jobs)
+		}
+	}
+}
+
+// list returns the workers, sorted by name.
+func (r *registry) list() []Worker {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	res := make([]Worker, 0, len(r.workers))
+	for _, w := range r.workers {
+		res = append(res, w.copy())
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].Name < res[b].Name })
+	return res
+}
+
+func (r *registry) get(name string) (Worker, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	w, ok := r.workers[name]
+	if !ok {
+		return Worker{}, false
+	}
+	return w.copy(), true
+}
+
+// countByState returns the number of alive and stale workers.
+func (r *registry) countByState() map[string]int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	res := map[string]int{"alive": 0, "stale": 0}
+	for _, w := range r.workers {
+		if w.Stale {
+			res["stale"]++
+		} else {
+			res["alive"]++
+		}
+	}
+	return res
+}
+
+func workerNotFound(w http.ResponseWriter, name string) {
+	writeError(w, http.StatusNotFound, &APIError{Code: CodeWorkerNotFound, Message: "Worker '" + name + "' is not registered"})
+}
+
+// GetWorkers lists the workers with the jobs they are processing.
+func GetWorkers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(idx.workers.list())
+}
+
+func GetWorker(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["w"]
+	wk, ok := idx.workers.get(name)
+	if !ok {
+		workerNotFound(w, name)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(wk)
+}
+
+// RegisterWorker registers a worker, or updates its description.
+func RegisterWorker(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	wk := Worker{Name: r.Form.Get("name"), Host: r.Form.Get("host"), Labels: make([]string, 0)}
+	if wk.Name == "" {
+		badRequest(w, CodeMissingParameter, "Missing required parameter 'name' to declare the worker name")
+		return
+	}
+	if strings.ContainsAny(wk.Name, "/ \t\n") {
+		badRequest(w, CodeInvalidParameter, "Invalid worker name '"+wk.Name+"'")
+		return
+	}
+	for _, l := range r.Form["l"] {
+		for _, x := range strings.Split(l, ",") {
+			if x = strings.TrimSpace(x); x != "" {
+				wk.Labels = append(wk.Labels, x)
+			}
+		}
+	}
+	if s := r.Form.Get("max"); s != "" {
+		var err error
+		if wk.MaxConcurrency, err = strconv.Atoi(s); err != nil || wk.MaxConcurrency < 0 {
+			badRequest(w, CodeInvalidParameter, "Invalid parameter 'max': expected a positive integer, got '"+s+"'")
+			return
+		}
+	}
+	wk = idx.workers.register(wk)
+	logger(r).Info("worker registered", "worker", wk.Name, "host", wk.Host)
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(wk)
+}
+
+func Heartbeat(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["w"]
+	if err := idx.workers.heartbeat(name); err != nil {
+		workerNotFound(w, name)
+	}
+}
+
+// UnregisterWorker forgets a worker. The jobs it was processing keep
+// their status, with an unknown owner.
+func UnregisterWorker(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["w"]
+	if !idx.workers.unregister(name) {
+		workerNotFound(w, name)
+		return
+	}
+	logger(r).Info("worker unregistered", "worker", name)
+}
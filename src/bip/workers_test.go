@@ -0,0 +1,113 @@
+/**
+ * Registry of the workers processing the jobs.
+ *
+ * @author Fabien Hermenier
+ */
+package bip
+
+import (
+	"testing"
+	"time"
+)
+
+// A repeated request to process a job must neither reserve the job twice
+// nor release the reservation of the processing.
+func TestProcessTwiceKeepsReservation(t *testing.T) {
+	idx, err := NewIndex(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.workers.register(Worker{Name: "w", MaxConcurrency: 2})
+	idx.workers.offer("w", Offer{Resources: map[string]int64{"cpu": 4}})
+	spec := JobSpec{Requirements: Requirements{Resources: map[string]int64{"cpu": 2}}}
+	if err = idx.NewJob("j", nil, spec, System); err != nil {
+		t.Fatal(err)
+	}
+	j, _ := idx.GetJob("j")
+	if err = j.Process("w", System); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := j.Process("w", System).(*StatusError); !ok {
+		t.Fatalf("processed twice")
+	}
+	w, _ := idx.workers.get("w")
+	if len(w.Jobs) != 1 || w.Held["cpu"] != 2 {
+		t.Fatalf("jobs %v holding %v, expected [j] holding 2 cpu", w.Jobs, w.Held)
+	}
+	for _, step := range []func(Actor) error{j.Terminating, j.Terminated} {
+		if err = step(System); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, _ = idx.workers.get("w")
+	if len(w.Jobs) != 0 || w.Held["cpu"] != 0 {
+		t.Errorf("jobs %v holding %v once terminated, expected none", w.Jobs, w.Held)
+	}
+}
+
+// A worker takes a job while it is below its concurrency and has the
+// resources it presented left.
+func TestReserve(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		max      int
+		offer    map[string]int64
+		needs    []map[string]int64
+		reserved int
+	}{
+		{"unbounded", 0, nil, []map[string]int64{nil, nil, nil}, 3},
+		{"concurrency", 2, nil, []map[string]int64{nil, nil, nil}, 2},
+		{"resources", 0, map[string]int64{"cpu": 4}, []map[string]int64{{"cpu": 2}, {"cpu": 2}, {"cpu": 1}}, 2},
+		{"unpresented resource", 0, map[string]int64{"cpu": 4}, []map[string]int64{{"gpu": 8}, {"gpu": 8}}, 2},
+		{"both", 1, map[string]int64{"cpu": 4}, []map[string]int64{{"cpu": 1}, {"cpu": 1}}, 1},
+	} {
+		r := newRegistry()
+		r.register(Worker{Name: "w", MaxConcurrency: tc.max})
+		r.offer("w", Offer{Resources: tc.offer})
+		for i, n := range tc.needs {
+			err := r.reserve("w", string(rune('a'+i)), n)
+			if busy := err != nil; busy != (i >= tc.reserved) {
+				t.Errorf("%s: job %d: got '%v'", tc.name, i, err)
+			} else if e, ok := err.(*WorkerError); err != nil && (!ok || !e.Busy) {
+				t.Errorf("%s: job %d: got '%v', expected a busy worker", tc.name, i, err)
+			}
+		}
+		w, _ := r.get("w")
+		if len(w.Jobs) != tc.reserved {
+			t.Errorf("%s: jobs %v, expected %d", tc.name, w.Jobs, tc.reserved)
+		}
+	}
+	if e, ok := newRegistry().reserve("x", "a", nil).(*WorkerError); !ok || e.Busy {
+		t.Errorf("expected an unknown worker")
+	}
+}
+
+// A worker without heartbeat is stale until it shows up again.
+func TestStaleWorkers(t *testing.T) {
+	r := newRegistry()
+	r.register(Worker{Name: "w"})
+	now := time.Now()
+	for _, tc := range []struct {
+		at         time.Duration
+		staleAfter time.Duration
+		alive      bool
+	}{
+		{time.Hour, 0, true},
+		{time.Second, time.Minute, true},
+		{2 * time.Minute, time.Minute, false},
+	} {
+		r.check(now.Add(tc.at), tc.staleAfter)
+		if r.alive("w") != tc.alive {
+			t.Errorf("after %s with a %s delay: alive is %v, expected %v", tc.at, tc.staleAfter, !tc.alive, tc.alive)
+		}
+	}
+	if r.countByState()["stale"] != 1 {
+		t.Errorf("expected a stale worker, got %v", r.countByState())
+	}
+	if err := r.heartbeat("w"); err != nil || !r.alive("w") {
+		t.Errorf("expected the worker to be alive after a heartbeat, got '%v'", err)
+	}
+	if _, ok := r.heartbeat("x").(*WorkerError); !ok {
+		t.Errorf("expected an unknown worker")
+	}
+}